@@ -17,8 +17,12 @@ limitations under the License.
 package v1alpha2
 
 import (
+	"encoding/json"
+
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -26,7 +30,10 @@ import (
 
 // CodeServerSpec defines the desired state of CodeServer
 type CodeServerSpec struct {
-	// Specifies the storage size that will be used for code server
+	// Specifies the storage size that will be used for code server.
+	// The size can be increased if the storage class allows volume expansion, but cannot be decreased.
+	// Code server pod is restarted to resize the file system only if the storage class is annotated with
+	// cs.walnuts.dev/offline-expansion: "true", otherwise the file system is resized online by the kubelet.
 	// +kubebuilder:validation:Pattern="^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$"
 	// +kubebuilder:default="1Gi"
 	StorageSize string `json:"storageSize,omitempty"`
@@ -40,6 +47,24 @@ type CodeServerSpec struct {
 	// VolumeName specifies the volume name for persistent volume claim
 	VolumeName string `json:"volumeName,omitempty"`
 
+	// ExistingClaim specifies an existing persistent volume claim in the same namespace used as the home volume.
+	// The claim is neither created nor owned by the CodeServer, so the storage fields, Source and ReclaimPolicy are ignored.
+	// It must not be in use by another CodeServer.
+	ExistingClaim string `json:"existingClaim,omitempty"`
+
+	// Specifies the data source of the persistent volume claim. It is only used when the claim is created.
+	Source *CodeServerSource `json:"source,omitempty"`
+
+	// Specifies what happens to the persistent volume claim when the CodeServer is deleted, defaults in Delete.
+	// +kubebuilder:default=Delete
+	ReclaimPolicy ReclaimPolicy `json:"reclaimPolicy,omitempty"`
+
+	// Specifies the bucket the home directory is archived to with the Archive reclaim policy.
+	Archive *ArchiveSpec `json:"archive,omitempty"`
+
+	// Specifies the additional volumes mounted into code server container, e.g. shared datasets or scratch space.
+	ExtraVolumes []ExtraVolume `json:"extraVolumes,omitempty"`
+
 	// Specifies the resource requirements for code server pod.
 	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
 
@@ -62,6 +87,36 @@ type CodeServerSpec struct {
 	// Specifies the node selector for scheduling.
 	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
 
+	// Specifies the tolerations for scheduling.
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+
+	// Specifies the affinity for scheduling.
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+
+	// Specifies the topology spread constraints for scheduling.
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+
+	// Specifies the priority class name for code server pod.
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+
+	// Specifies the runtime class name for code server pod.
+	RuntimeClassName *string `json:"runtimeClassName,omitempty"`
+
+	// Specifies the scheduler name for code server pod.
+	SchedulerName string `json:"schedulerName,omitempty"`
+
+	// Specifies the security context of code server pod.
+	SecurityContext *CodeServerSecurityContext `json:"securityContext,omitempty"`
+
+	// Specifies the readiness probe of code server container, defaults in an HTTP GET of /healthz on the container port.
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+
+	// Specifies the liveness probe of code server container, defaults in an HTTP GET of /healthz on the container port.
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+
+	// Specifies the startup probe of code server container, defaults in an HTTP GET of /healthz on the container port.
+	StartupProbe *corev1.Probe `json:"startupProbe,omitempty"`
+
 	// Specifies the terminal container port for connection, defaults in 19200.
 	// +kubebuilder:default=19200
 	ContainerPort int32 `json:"containerPort,omitempty"`
@@ -69,29 +124,576 @@ type CodeServerSpec struct {
 	// ImagePullSecrets is an optional list of references to secrets in the same namespace to use for pulling any of the images used by this PodSpec.
 	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
 
+	// Exposure specifies how code server is exposed outside of the cluster, defaults in Ingress.
+	// +kubebuilder:default=Ingress
+	Exposure Exposure `json:"exposure,omitempty"`
+
+	// Routing specifies the resource that routes the host to code server if Exposure is Ingress, defaults in Ingress.
+	// HTTPRoute requires the Gateway API CRDs and Gateway.
+	// +kubebuilder:default=Ingress
+	Routing Routing `json:"routing,omitempty"`
+
+	// Gateway is the parent Gateway the HTTPRoute is attached to. Required if Routing is HTTPRoute.
+	Gateway *GatewayReference `json:"gateway,omitempty"`
+
 	IngressClassName string `json:"ingressClassName,omitempty"`
 
-	// PublicProxyPorts specifies the public proxy ports for code server
+	// IngressAnnotations specifies the additional annotations of the Ingress, e.g. auth or body size settings of the ingress controller.
+	IngressAnnotations map[string]string `json:"ingressAnnotations,omitempty"`
+
+	// HostTemplate is a Go template of the host of the Ingress, e.g. "{{ .Labels.user }}.{{ .Namespace }}.{{ .Domain }}".
+	// Name, Namespace, Labels and Domain of the CodeServer are available in the template.
+	// Defaults to "{{ .Name }}.{{ .Domain }}", or "{{ .Domain }}" if PathPrefixTemplate is specified.
+	HostTemplate string `json:"hostTemplate,omitempty"`
+
+	// PathPrefixTemplate is a Go template of the path prefix, e.g. "/{{ .Namespace }}/{{ .Name }}",
+	// to serve code server under a path of a shared host instead of its own host, for clusters without wildcard DNS.
+	// The prefix is stripped with the rewrite annotations of ingress-nginx.
+	PathPrefixTemplate string `json:"pathPrefixTemplate,omitempty"`
+
+	// TLS specifies the TLS configuration of the Ingress.
+	TLS *IngressTLS `json:"tls,omitempty"`
+
+	// PublicProxyPorts specifies the public proxy ports for code server. Ports of sidecars can be exposed as well.
 	PublicProxyPorts []int32 `json:"publicProxyPorts,omitempty"`
 
+	// Password specifies the password of code server if Auth is Password.
+	// A password is generated into the secret of the CodeServer if SecretName is not specified.
+	Password *CodeServerPassword `json:"password,omitempty"`
+
+	// Owner specifies the user or group the CodeServer belongs to.
+	// The owner is granted to get the CodeServer and the secret of its password, and is set to the labels of its resources.
+	// Patch is not granted, since the owner could change any field of the spec with it.
+	// A secret specified with Password.SecretName must be readable by the user who applies the CodeServer.
+	Owner *CodeServerOwner `json:"owner,omitempty"`
+
+	// Auth specifies how the users of code server are authenticated.
+	// The password in the secret of the CodeServer is used if not specified.
+	Auth *CodeServerAuth `json:"auth,omitempty"`
+
+	// NetworkPolicy creates a NetworkPolicy that isolates code server pod from the other pods.
+	NetworkPolicy *CodeServerNetworkPolicy `json:"networkPolicy,omitempty"`
+
+	// PortDiscovery enables the discovery of the ports code server pod is listening on.
+	// The discovered ports are exposed in the same way as PublicProxyPorts.
+	PortDiscovery *PortDiscovery `json:"portDiscovery,omitempty"`
+
+	// ProxyMode specifies how PublicProxyPorts are exposed, defaults in Path.
+	// +kubebuilder:default=Path
+	ProxyMode ProxyMode `json:"proxyMode,omitempty"`
+
+	// Sidecars specifies the containers running next to code server.
+	// Sidecars with restartPolicy Always are added as native sidecar init containers.
+	Sidecars []Sidecar `json:"sidecars,omitempty"`
+
 	//InitCommand specifies the init commands that will be running to finish before code server running.
 	InitCommand string `json:"initCommand,omitempty"`
+
+	// PodTemplate specifies a partial pod template that is merged over the generated pod template
+	// with strategic merge patch semantics, e.g. to add sidecars, volumes, labels, annotations or probes.
+	// The home volume and the password env of the code server container cannot be overridden.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:validation:Type=object
+	PodTemplate *runtime.RawExtension `json:"podTemplate,omitempty"`
 }
 
-// CodeServerStatus defines the observed state of CodeServer
+// CodeServerSource defines the data source of the home volume of a new CodeServer.
+// Only one of VolumeSnapshotName and CodeServerName can be specified.
+// The password is not copied from the source, a new one is generated.
+type CodeServerSource struct {
+	// VolumeSnapshotName is the name of a VolumeSnapshot in the same namespace to restore the home volume from,
+	// e.g. one listed in the status of a CodeServerSnapshot. StorageSize must not be less than the snapshot.
+	VolumeSnapshotName string `json:"volumeSnapshotName,omitempty"`
+
+	// CodeServerName is the name of a CodeServer in the same namespace whose home volume is cloned.
+	// StorageSize must not be less than the home volume of the source.
+	CodeServerName string `json:"codeServerName,omitempty"`
+
+	// CloneMethod specifies how the home volume of CodeServerName is cloned, defaults in Auto.
+	// +kubebuilder:default=Auto
+	CloneMethod CloneMethod `json:"cloneMethod,omitempty"`
+}
+
+// CloneMethod specifies how the home volume of another CodeServer is cloned.
+// +kubebuilder:validation:Enum=Auto;CSIClone;Copy
+type CloneMethod string
+
+const (
+	// CloneMethodAuto uses CSIClone if the storage class of both volumes is the same, is provisioned by a CSI driver
+	// and is annotated with "cs.walnuts.dev/volume-clone: true" to tell the driver supports cloning, otherwise Copy.
+	CloneMethodAuto CloneMethod = "Auto"
+	// CloneMethodCSIClone provisions the volume with the source volume as its dataSourceRef.
+	CloneMethodCSIClone CloneMethod = "CSIClone"
+	// CloneMethodCopy provisions an empty volume and copies the files of the source volume with a Job.
+	CloneMethodCopy CloneMethod = "Copy"
+)
+
+// IngressTLS defines the TLS configuration of the Ingress.
+// Either a secret per CodeServer, issued by cert-manager if an issuer is specified, or a shared wildcard secret is used.
+type IngressTLS struct {
+	// SecretName is a Go template of the name of the TLS secret, e.g. "{{ .Name }}-tls".
+	// Name, Namespace, Labels and Domain of the CodeServer are available in the template.
+	// +kubebuilder:default="{{ .Name }}-tls"
+	SecretName string `json:"secretName,omitempty"`
+
+	// WildcardSecretName is the name of a TLS secret for *.<domain> in the same namespace, shared by CodeServers.
+	// SecretName is ignored if specified.
+	WildcardSecretName string `json:"wildcardSecretName,omitempty"`
+
+	// ClusterIssuer is the name of the cert-manager ClusterIssuer that issues the certificate into SecretName.
+	ClusterIssuer string `json:"clusterIssuer,omitempty"`
+
+	// Issuer is the name of the cert-manager Issuer in the same namespace that issues the certificate into SecretName.
+	Issuer string `json:"issuer,omitempty"`
+}
+
+// ReclaimPolicy specifies what happens to the persistent volume claim when the CodeServer is deleted.
+// +kubebuilder:validation:Enum=Delete;Retain;Archive
+type ReclaimPolicy string
+
+const (
+	// ReclaimPolicyDelete deletes the persistent volume claim with the CodeServer.
+	ReclaimPolicyDelete ReclaimPolicy = "Delete"
+	// ReclaimPolicyRetain keeps the persistent volume claim, labeled with the name of the CodeServer.
+	// A CodeServer with the same name adopts the claim again.
+	ReclaimPolicyRetain ReclaimPolicy = "Retain"
+	// ReclaimPolicyArchive uploads a tarball of the home directory to an S3 compatible bucket
+	// before the persistent volume claim is deleted.
+	ReclaimPolicyArchive ReclaimPolicy = "Archive"
+)
+
+// Exposure specifies how code server is exposed outside of the cluster.
+// +kubebuilder:validation:Enum=Ingress;None;NodePort;LoadBalancer
+type Exposure string
+
+const (
+	// ExposureIngress routes the host rendered from HostTemplate with the resource of Routing.
+	// Nothing is routed if the host is empty, e.g. Domain is not specified.
+	ExposureIngress Exposure = "Ingress"
+	// ExposureNone exposes code server only inside the cluster, e.g. for kubectl port-forward.
+	ExposureNone Exposure = "None"
+	// ExposureNodePort exposes the service of code server on the ports of the nodes.
+	ExposureNodePort Exposure = "NodePort"
+	// ExposureLoadBalancer exposes the service of code server with a load balancer of the cloud provider.
+	ExposureLoadBalancer Exposure = "LoadBalancer"
+)
+
+// Routing specifies the resource that routes the traffic to code server.
+// +kubebuilder:validation:Enum=Ingress;HTTPRoute
+type Routing string
+
+const (
+	// RoutingIngress creates a networking.k8s.io Ingress.
+	RoutingIngress Routing = "Ingress"
+	// RoutingHTTPRoute creates a Gateway API HTTPRoute attached to Gateway.
+	RoutingHTTPRoute Routing = "HTTPRoute"
+)
+
+// CodeServerPassword defines the password of code server.
+type CodeServerPassword struct {
+	// SecretName is the name of an existing secret in the same namespace holding the password, used instead of the generated one.
+	// code server pod is restarted when the secret is changed.
+	SecretName string `json:"secretName,omitempty"`
+
+	// Key is the key of the password in SecretName, defaults in password.
+	// +kubebuilder:default=password
+	Key string `json:"key,omitempty"`
+
+	// Hashed passes an argon2id hash of the password to code server in HASHED_PASSWORD instead of the plain PASSWORD,
+	// so that the password is not exposed in the environment of code server.
+	Hashed bool `json:"hashed,omitempty"`
+
+	// RotationIntervalSeconds specifies the interval to regenerate the password and restart code server pod.
+	// The password can also be rotated at any time by annotating the CodeServer with cs.walnuts.dev/rotate-password.
+	// It cannot be used with SecretName.
+	// +kubebuilder:validation:Minimum=60
+	RotationIntervalSeconds *int64 `json:"rotationIntervalSeconds,omitempty"`
+}
+
+// CodeServerOwner defines the user or group a CodeServer belongs to.
+type CodeServerOwner struct {
+	// Kind is the kind of the subject bound to the role of the owner, defaults in User.
+	// +kubebuilder:default=User
+	Kind OwnerKind `json:"kind,omitempty"`
+
+	// Name is the name of the user or group as authenticated by the API server, e.g. the email of an OIDC user.
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// OwnerKind specifies the kind of the owner of a CodeServer.
+// +kubebuilder:validation:Enum=User;Group
+type OwnerKind string
+
+const (
+	// OwnerKindUser is a user authenticated by the API server.
+	OwnerKindUser OwnerKind = "User"
+	// OwnerKindGroup is a group of users authenticated by the API server.
+	OwnerKindGroup OwnerKind = "Group"
+)
+
+// CodeServerAuth defines the authentication in front of code server.
+// code server runs with --auth none unless Mode is Password.
+type CodeServerAuth struct {
+	// Mode specifies how the users are authenticated, defaults in Password.
+	// +kubebuilder:default=Password
+	Mode AuthMode `json:"mode,omitempty"`
+
+	// AllowedEmails restricts the access to the users with the emails, e.g. the owner of code server.
+	AllowedEmails []string `json:"allowedEmails,omitempty"`
+
+	// AllowedGroups restricts the access to the members of the groups.
+	// Both AllowedEmails and AllowedGroups must be satisfied if both are specified.
+	AllowedGroups []string `json:"allowedGroups,omitempty"`
+
+	// OAuth2Proxy configures the oauth2-proxy sidecar. Required if Mode is OAuth2Proxy.
+	OAuth2Proxy *OAuth2Proxy `json:"oauth2Proxy,omitempty"`
+
+	// ForwardAuth configures the external authentication of the ingress controller. Required if Mode is ForwardAuth.
+	ForwardAuth *ForwardAuth `json:"forwardAuth,omitempty"`
+}
+
+// AuthMode specifies how the users of code server are authenticated.
+// +kubebuilder:validation:Enum=Password;OAuth2Proxy;ForwardAuth
+type AuthMode string
+
+const (
+	// AuthModePassword authenticates the users with the password of code server.
+	AuthModePassword AuthMode = "Password"
+	// AuthModeOAuth2Proxy puts an oauth2-proxy sidecar in front of code server, which authenticates the users with an OIDC provider.
+	AuthModeOAuth2Proxy AuthMode = "OAuth2Proxy"
+	// AuthModeForwardAuth sets the ingress-nginx annotations to authenticate the requests with an external oauth2-proxy.
+	// It requires the Ingress exposure and routing with ingress-nginx, as other ingress controllers ignore the annotations.
+	AuthModeForwardAuth AuthMode = "ForwardAuth"
+)
+
+// OAuth2Proxy defines the oauth2-proxy sidecar authenticating the users with an OIDC provider.
+type OAuth2Proxy struct {
+	// IssuerURL is the URL of the OIDC issuer, e.g. https://accounts.google.com.
+	IssuerURL string `json:"issuerURL"`
+
+	// ClientID is the OAuth client ID.
+	ClientID string `json:"clientID"`
+
+	// ClientSecretName is the name of a secret in the same namespace with the client-secret key.
+	ClientSecretName string `json:"clientSecretName"`
+
+	// Image is the image of oauth2-proxy.
+	// +kubebuilder:default="quay.io/oauth2-proxy/oauth2-proxy:v7.7.1"
+	Image string `json:"image,omitempty"`
+
+	// Port is the port oauth2-proxy listens on, defaults in 4180.
+	// +kubebuilder:default=4180
+	Port int32 `json:"port,omitempty"`
+
+	// ExtraArgs is appended to the arguments of oauth2-proxy, e.g. --ssl-insecure-skip-verify for a local mock OIDC provider.
+	ExtraArgs []string `json:"extraArgs,omitempty"`
+}
+
+// ForwardAuth defines the external authentication of the ingress controller, e.g. a shared oauth2-proxy.
+type ForwardAuth struct {
+	// URL is the endpoint authenticating the requests, e.g. https://oauth2-proxy.example.com/oauth2/auth.
+	// AllowedEmails and AllowedGroups are appended as the allowed_emails and allowed_groups query parameters of oauth2-proxy.
+	URL string `json:"url"`
+
+	// SignInURL is the URL the unauthenticated users are redirected to, e.g. https://oauth2-proxy.example.com/oauth2/start?rd=$escaped_request_uri.
+	SignInURL string `json:"signInURL,omitempty"`
+
+	// ResponseHeaders is the list of headers of the authentication response passed to code server.
+	ResponseHeaders []string `json:"responseHeaders,omitempty"`
+}
+
+// CodeServerNetworkPolicy defines the traffic allowed to and from code server pod.
+// Only the ingress controller, the activator and the operator scanning the ports can connect to code server,
+// so it cannot be used with the NodePort and LoadBalancer exposures.
+// Egress other than Open cannot be used with OAuth2Proxy or the git init plugin, which need to reach the outside.
+type CodeServerNetworkPolicy struct {
+	// IngressControllerNamespace is the namespace of the ingress controller or the Gateway, defaults in ingress-nginx.
+	// +kubebuilder:default=ingress-nginx
+	IngressControllerNamespace string `json:"ingressControllerNamespace,omitempty"`
+
+	// Activator allows the activator, which proxies the requests to suspended code server, to connect to code server.
+	Activator *NetworkPolicyPeer `json:"activator,omitempty"`
+
+	// Egress specifies the traffic allowed from code server pod, defaults in Open.
+	// +kubebuilder:default=Open
+	Egress EgressPolicy `json:"egress,omitempty"`
+
+	// EgressCIDRs is the list of CIDRs code server can connect to if Egress is Allowlist.
+	EgressCIDRs []string `json:"egressCIDRs,omitempty"`
+}
+
+// NetworkPolicyPeer selects the pods in a namespace.
+type NetworkPolicyPeer struct {
+	// Namespace of the pods.
+	Namespace string `json:"namespace"`
+
+	// PodSelector is the labels of the pods. All pods in Namespace are selected if not specified.
+	PodSelector map[string]string `json:"podSelector,omitempty"`
+}
+
+// EgressPolicy specifies the traffic allowed from code server pod.
+// +kubebuilder:validation:Enum=Open;Allowlist;None
+type EgressPolicy string
+
+const (
+	// EgressPolicyOpen allows all traffic.
+	EgressPolicyOpen EgressPolicy = "Open"
+	// EgressPolicyAllowlist allows DNS and the traffic to EgressCIDRs.
+	EgressPolicyAllowlist EgressPolicy = "Allowlist"
+	// EgressPolicyNone denies all traffic, including DNS.
+	EgressPolicyNone EgressPolicy = "None"
+)
+
+// PortDiscovery defines the ports scanned by the operator through the pod IP.
+// The ports of code server, oauth2-proxy and the sidecars are never discovered.
+// The discovered ports are exposed only up to MaxProxyPorts including PublicProxyPorts.
+type PortDiscovery struct {
+	// Allow is the list of port ranges to scan, defaults to 3000-8999 where development servers usually listen.
+	Allow []PortRange `json:"allow,omitempty"`
+
+	// Deny is the list of port ranges excluded from Allow.
+	Deny []PortRange `json:"deny,omitempty"`
+
+	// IntervalSeconds is the interval of the scan, defaults in 30.
+	// +kubebuilder:default=30
+	// +kubebuilder:validation:Minimum=5
+	IntervalSeconds int32 `json:"intervalSeconds,omitempty"`
+}
+
+// MaxProxyPorts is the maximum number of the proxy ports routed by HTTPRoute,
+// which allows up to 16 rules and hostnames including the ones of code server itself.
+const MaxProxyPorts = 15
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	// Start is the first port of the range.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Start int32 `json:"start"`
+
+	// End is the last port of the range, defaults to Start.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	End int32 `json:"end,omitempty"`
+}
+
+// ProxyMode specifies how the public proxy ports are exposed.
+// +kubebuilder:validation:Enum=Path;Subdomain
+type ProxyMode string
+
+const (
+	// ProxyModePath exposes each port at /proxy/<port> of the host of code server.
+	ProxyModePath ProxyMode = "Path"
+	// ProxyModeSubdomain exposes each port at <port>-<host of code server>, e.g. 3000-alice.example.com,
+	// proxied by code server with --proxy-domain. Dev servers which do not support a path prefix work as they are.
+	// It cannot be used with PathPrefixTemplate.
+	ProxyModeSubdomain ProxyMode = "Subdomain"
+)
+
+// GatewayReference identifies the parent Gateway of the HTTPRoute.
+// HostTemplate, PathPrefixTemplate and PublicProxyPorts are routed in the same way as the Ingress,
+// while TLS is terminated by the listeners of the Gateway.
+type GatewayReference struct {
+	// Name of the Gateway.
+	Name string `json:"name"`
+
+	// Namespace of the Gateway, defaults to the namespace of the CodeServer.
+	Namespace string `json:"namespace,omitempty"`
+
+	// SectionName is the name of the listener to attach to. All listeners are used if not specified.
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// ArchiveSpec defines the S3 compatible bucket the home directory is archived to.
+// The object key is <prefix><namespace>/<name>/<deletion time>.tar.gz.
+type ArchiveSpec struct {
+	// Endpoint is the URL of the S3 compatible API, e.g. http://minio.minio.svc:9000. AWS S3 is used if not specified.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Region of the bucket, defaults in us-east-1.
+	// +kubebuilder:default=us-east-1
+	Region string `json:"region,omitempty"`
+
+	// Bucket is the name of the bucket.
+	Bucket string `json:"bucket"`
+
+	// Prefix is prepended to the object key.
+	Prefix string `json:"prefix,omitempty"`
+
+	// CredentialsSecretName is the name of a secret in the same namespace with the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY keys.
+	CredentialsSecretName string `json:"credentialsSecretName"`
+
+	// Image is the image of the AWS CLI which uploads the archive. The archive itself is created with the image of code server.
+	// +kubebuilder:default="amazon/aws-cli:2.17.0"
+	Image string `json:"image,omitempty"`
+}
+
+// ExtraVolume defines an additional volume mounted into code server container.
+// Exactly one of the volume sources must be specified.
+type ExtraVolume struct {
+	// Name of the volume. Must be unique and must not be "home".
+	Name string `json:"name"`
+
+	// Path within code server container at which the volume is mounted. Must not shadow or be under /home/coder.
+	MountPath string `json:"mountPath"`
+
+	// Specifies whether the volume is mounted read-only.
+	ReadOnly bool `json:"readOnly,omitempty"`
+
+	// PersistentVolumeClaim mounts an existing persistent volume claim, e.g. a shared dataset.
+	PersistentVolumeClaim *corev1.PersistentVolumeClaimVolumeSource `json:"persistentVolumeClaim,omitempty"`
+
+	// ConfigMap mounts a config map.
+	ConfigMap *corev1.ConfigMapVolumeSource `json:"configMap,omitempty"`
+
+	// Secret mounts a secret.
+	Secret *corev1.SecretVolumeSource `json:"secret,omitempty"`
+
+	// EmptyDir mounts a scratch directory that shares the lifetime of the pod.
+	EmptyDir *corev1.EmptyDirVolumeSource `json:"emptyDir,omitempty"`
+
+	// CSI mounts a CSI ephemeral volume.
+	CSI *corev1.CSIVolumeSource `json:"csi,omitempty"`
+}
+
+// Sidecar defines a container running next to code server
+type Sidecar struct {
+	corev1.Container `json:",inline"`
+
+	// Specifies whether the home volume of code server is mounted at /home/coder.
+	MountHome bool `json:"mountHome,omitempty"`
+}
+
+// SecurityContextProfile specifies a preset of security contexts for code server pod.
+// +kubebuilder:validation:Enum=baseline;restricted;custom
+type SecurityContextProfile string
+
+const (
+	// SecurityContextProfileBaseline only sets the user, group and fsGroup of the pod.
+	SecurityContextProfileBaseline SecurityContextProfile = "baseline"
+	// SecurityContextProfileRestricted complies with the Pod Security Admission restricted profile.
+	SecurityContextProfileRestricted SecurityContextProfile = "restricted"
+	// SecurityContextProfileCustom uses the pod and container security contexts as specified.
+	SecurityContextProfileCustom SecurityContextProfile = "custom"
+)
+
+// CodeServerSecurityContext defines the security context of code server pod
+type CodeServerSecurityContext struct {
+	// Specifies the preset of security contexts, defaults in baseline.
+	// +kubebuilder:default=baseline
+	Profile SecurityContextProfile `json:"profile,omitempty"`
+
+	// Specifies the UID to run containers as, defaults in 1000. Not used by the custom profile.
+	RunAsUser *int64 `json:"runAsUser,omitempty"`
+
+	// Specifies the GID to run containers as, defaults in 1000. Not used by the custom profile.
+	RunAsGroup *int64 `json:"runAsGroup,omitempty"`
+
+	// Specifies the fsGroup of the pod, defaults in 1000. Not used by the custom profile.
+	FSGroup *int64 `json:"fsGroup,omitempty"`
+
+	// Specifies the pod security context for the custom profile.
+	Pod *corev1.PodSecurityContext `json:"pod,omitempty"`
+
+	// Specifies the security context of all containers, including init containers, for the custom profile.
+	Container *corev1.SecurityContext `json:"container,omitempty"`
+}
+
+// CodeServerPhase defines the phase of CodeServer
 // +kubebuilder:validation:Enum=NotReady;Ready;Suspended
-type CodeServerStatus string
+type CodeServerPhase string
 
 const (
-	CodeServerNotReady  CodeServerStatus = "NotReady"
-	CodeServerReady     CodeServerStatus = "Ready"
-	CodeServerSuspended CodeServerStatus = "Suspended"
+	CodeServerNotReady  CodeServerPhase = "NotReady"
+	CodeServerReady     CodeServerPhase = "Ready"
+	CodeServerSuspended CodeServerPhase = "Suspended"
 )
 
+const (
+	// ConditionTypeReady indicates whether code server pod is ready to serve.
+	ConditionTypeReady = "Ready"
+	// ConditionTypeStorageResized indicates whether the capacity of the persistent volume claim matches StorageSize.
+	ConditionTypeStorageResized = "StorageResized"
+	// ConditionTypeRouteAccepted indicates whether the HTTPRoute is accepted by the parent Gateway.
+	ConditionTypeRouteAccepted = "RouteAccepted"
+	// ConditionTypePodHealthy indicates whether code server pod is running without a failure,
+	// e.g. a failed init container, an image pull error or a crash loop.
+	ConditionTypePodHealthy = "PodHealthy"
+)
+
+// CodeServerStatus defines the observed state of CodeServer
+type CodeServerStatus struct {
+	// Phase is the summary of the conditions of CodeServer.
+	Phase CodeServerPhase `json:"phase,omitempty"`
+
+	// Conditions represent the latest available observations of CodeServer.
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// Storage is the observed state of the persistent volume claim.
+	Storage *CodeServerStorageStatus `json:"storage,omitempty"`
+
+	// URL is the public URL of code server, empty while it is not exposed or the address is not assigned.
+	URL string `json:"url,omitempty"`
+
+	// DiscoveredPorts is the list of ports found listening by PortDiscovery.
+	DiscoveredPorts []int32 `json:"discoveredPorts,omitempty"`
+
+	// PortsScannedAt is the time of the scan which found the discovered ports, updated only when they change.
+	PortsScannedAt *metav1.Time `json:"portsScannedAt,omitempty"`
+
+	// PasswordRotatedAt is the last time the password was rotated, or the secret of the password was changed.
+	PasswordRotatedAt *metav1.Time `json:"passwordRotatedAt,omitempty"`
+}
+
+// CodeServerStorageStatus defines the observed state of the persistent volume claim
+type CodeServerStorageStatus struct {
+	// Capacity is the actual capacity of the persistent volume claim.
+	Capacity *resource.Quantity `json:"capacity,omitempty"`
+
+	// FileSystemResizePending indicates that the volume has been expanded
+	// and the file system is waiting to be resized on the node.
+	FileSystemResizePending bool `json:"fileSystemResizePending,omitempty"`
+}
+
+// HomeClaimName returns the name of the persistent volume claim used as the home volume.
+func (r *CodeServer) HomeClaimName() string {
+	if r.Spec.ExistingClaim != "" {
+		return r.Spec.ExistingClaim
+	}
+	return r.Name
+}
+
+// PasswordSecretName returns the name of the secret holding the password of code server.
+func (r *CodeServer) PasswordSecretName() string {
+	if r.Spec.Password != nil && r.Spec.Password.SecretName != "" {
+		return r.Spec.Password.SecretName
+	}
+	return r.Name
+}
+
+// UnmarshalJSON also accepts the legacy status, which was the phase string itself.
+// The controller migrates the stored legacy status into an object before updating the CodeServer.
+func (s *CodeServerStatus) UnmarshalJSON(data []byte) error {
+	var phase CodeServerPhase
+	if err := json.Unmarshal(data, &phase); err == nil {
+		*s = CodeServerStatus{Phase: phase}
+		return nil
+	}
+
+	type status CodeServerStatus
+	return json.Unmarshal(data, (*status)(s))
+}
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 //+kubebuilder:printcolumn:name="STORAGE",type="string",JSONPath=".spec.storageSize",description="Storage size"
-//+kubebuilder:printcolumn:name="STATUS",type="string",JSONPath=".status",description="CodeServer status"
+//+kubebuilder:printcolumn:name="CAPACITY",type="string",JSONPath=".status.storage.capacity",description="Actual storage capacity",priority=1
+//+kubebuilder:printcolumn:name="STATUS",type="string",JSONPath=".status.phase",description="CodeServer status"
+//+kubebuilder:printcolumn:name="URL",type="string",JSONPath=".status.url",description="Public URL",priority=1
 //+kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
 
 // CodeServer is the Schema for the codeservers API
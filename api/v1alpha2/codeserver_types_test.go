@@ -0,0 +1,73 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// TestPrinterColumns checks that every printer column of the generated CRDs points to a scalar field of the schema,
+// so that a column is not left pointing to a field which has been changed into an object, like the legacy status.
+func TestPrinterColumns(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "..", "config", "crd", "bases", "*.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no CRDs are found")
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var crd apiextensionsv1.CustomResourceDefinition
+		if err := yaml.Unmarshal(data, &crd); err != nil {
+			t.Fatalf("failed to decode %s: %v", path, err)
+		}
+
+		for _, version := range crd.Spec.Versions {
+			for _, column := range version.AdditionalPrinterColumns {
+				t.Run(crd.Spec.Names.Kind+"/"+version.Name+"/"+column.Name, func(t *testing.T) {
+					schema := version.Schema.OpenAPIV3Schema
+					fields := strings.Split(strings.TrimPrefix(column.JSONPath, "."), ".")
+					if fields[0] == "metadata" {
+						// The schema of the object metadata is not included in CRDs.
+						return
+					}
+					for _, field := range fields {
+						property, ok := schema.Properties[field]
+						if !ok {
+							t.Fatalf("%s is not found in the schema", column.JSONPath)
+						}
+						schema = &property
+					}
+					if schema.Type == "object" || schema.Type == "array" {
+						t.Errorf("%s is not a scalar but %s", column.JSONPath, schema.Type)
+					}
+				})
+			}
+		}
+	}
+}
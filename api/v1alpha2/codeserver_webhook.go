@@ -17,8 +17,27 @@ limitations under the License.
 package v1alpha2
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/walnuts1018/code-server-operator/internal/initplugins"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
@@ -27,10 +46,26 @@ import (
 // log is for logging in this package.
 var codeserverlog = logf.Log.WithName("codeserver-resource")
 
+const (
+	codeServerContainerName = "code-server"
+	homeVolumeName          = "home"
+	homeMountPath           = "/home/coder"
+	passwordEnvName         = "PASSWORD"
+	hashedPasswordEnvName   = "HASHED_PASSWORD"
+)
+
+// reservedPodLabels are the labels used by the Deployment selector of the code server.
+var reservedPodLabels = []string{
+	"app.kubernetes.io/name",
+	"app.kubernetes.io/instance",
+	"app.kubernetes.io/created-by",
+}
+
 // SetupWebhookWithManager will setup the manager to manage the webhooks
 func (r *CodeServer) SetupWebhookWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewWebhookManagedBy(mgr).
 		For(r).
+		WithValidator(&codeServerValidator{client: mgr.GetClient()}).
 		Complete()
 }
 
@@ -56,16 +91,14 @@ var _ webhook.Validator = &CodeServer{}
 func (r *CodeServer) ValidateCreate() (admission.Warnings, error) {
 	codeserverlog.Info("validate create", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object creation.
-	return nil, nil
+	return nil, r.validateCodeServer()
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *CodeServer) ValidateUpdate(old runtime.Object) (admission.Warnings, error) {
 	codeserverlog.Info("validate update", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object update.
-	return nil, nil
+	return nil, r.validateCodeServer()
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
@@ -75,3 +108,594 @@ func (r *CodeServer) ValidateDelete() (admission.Warnings, error) {
 	// TODO(user): fill in your validation logic upon object deletion.
 	return nil, nil
 }
+
+//+kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// codeServerValidator validates a CodeServer against the other resources in the cluster in addition to its spec.
+type codeServerValidator struct {
+	client client.Client
+}
+
+var _ webhook.CustomValidator = &codeServerValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *codeServerValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	codeServer, ok := obj.(*CodeServer)
+	if !ok {
+		return nil, fmt.Errorf("expected a CodeServer but got a %T", obj)
+	}
+
+	warnings, err := codeServer.ValidateCreate()
+	if err != nil {
+		return warnings, err
+	}
+	if err := v.validateHomeClaim(ctx, codeServer); err != nil {
+		return warnings, err
+	}
+	return warnings, v.validatePasswordSecret(ctx, codeServer)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *codeServerValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	codeServer, ok := newObj.(*CodeServer)
+	if !ok {
+		return nil, fmt.Errorf("expected a CodeServer but got a %T", newObj)
+	}
+	old, ok := oldObj.(*CodeServer)
+	if !ok {
+		return nil, fmt.Errorf("expected a CodeServer but got a %T", oldObj)
+	}
+
+	warnings, err := codeServer.ValidateUpdate(old)
+	if err != nil {
+		return warnings, err
+	}
+	if codeServer.Spec.ExistingClaim != old.Spec.ExistingClaim {
+		if err := v.validateHomeClaim(ctx, codeServer); err != nil {
+			return warnings, err
+		}
+	}
+	if !equality.Semantic.DeepEqual(codeServer.Spec.Owner, old.Spec.Owner) || codeServer.PasswordSecretName() != old.PasswordSecretName() {
+		return warnings, v.validatePasswordSecret(ctx, codeServer)
+	}
+	return warnings, nil
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type
+func (v *codeServerValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	codeServer, ok := obj.(*CodeServer)
+	if !ok {
+		return nil, fmt.Errorf("expected a CodeServer but got a %T", obj)
+	}
+	return codeServer.ValidateDelete()
+}
+
+// validateHomeClaim checks that the existing claim exists and that the home volume of the CodeServer,
+// either the existing claim or the PVC named after the CodeServer, is not the home volume of another CodeServer.
+func (v *codeServerValidator) validateHomeClaim(ctx context.Context, codeServer *CodeServer) error {
+	fldPath := field.NewPath("metadata", "name")
+	if codeServer.Spec.ExistingClaim != "" {
+		fldPath = field.NewPath("spec", "existingClaim")
+
+		var pvc corev1.PersistentVolumeClaim
+		err := v.client.Get(ctx, client.ObjectKey{Name: codeServer.Spec.ExistingClaim, Namespace: codeServer.Namespace}, &pvc)
+		if apierrors.IsNotFound(err) {
+			return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "CodeServer"}, codeServer.Name, field.ErrorList{
+				field.NotFound(fldPath, codeServer.Spec.ExistingClaim),
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get existing claim: %w", err)
+		}
+	}
+
+	var codeServers CodeServerList
+	if err := v.client.List(ctx, &codeServers, client.InNamespace(codeServer.Namespace)); err != nil {
+		return fmt.Errorf("failed to list CodeServers: %w", err)
+	}
+	if user := claimUser(codeServers.Items, codeServer); user != "" {
+		return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "CodeServer"}, codeServer.Name, field.ErrorList{
+			field.Invalid(fldPath, codeServer.HomeClaimName(), fmt.Sprintf("PVC %q is in use by CodeServer %q", codeServer.HomeClaimName(), user)),
+		})
+	}
+	return nil
+}
+
+// validatePasswordSecret checks that the user applying the CodeServer can get the secret specified with Password.SecretName
+// if Owner is specified, since the owner is granted to get the secret of the password.
+// Otherwise, anyone who can create a CodeServer could read any secret in the namespace by specifying it with themselves as the owner.
+func (v *codeServerValidator) validatePasswordSecret(ctx context.Context, codeServer *CodeServer) error {
+	if codeServer.Spec.Owner == nil || codeServer.Spec.Password == nil || codeServer.Spec.Password.SecretName == "" {
+		return nil
+	}
+
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get admission request: %w", err)
+	}
+
+	review := secretAccessReview(req.UserInfo, codeServer.Namespace, codeServer.Spec.Password.SecretName)
+	if err := v.client.Create(ctx, review); err != nil {
+		return fmt.Errorf("failed to review access to password secret: %w", err)
+	}
+	if !review.Status.Allowed {
+		return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "CodeServer"}, codeServer.Name, field.ErrorList{
+			field.Forbidden(field.NewPath("spec", "password", "secretName"), fmt.Sprintf("%s cannot get secret %q, which would be granted to the owner", req.UserInfo.Username, codeServer.Spec.Password.SecretName)),
+		})
+	}
+	return nil
+}
+
+// secretAccessReview returns the review of whether the user can get the secret.
+func secretAccessReview(user authenticationv1.UserInfo, namespace, name string) *authorizationv1.SubjectAccessReview {
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for key, value := range user.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+
+	return &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: namespace,
+				Verb:      "get",
+				Resource:  "secrets",
+				Name:      name,
+			},
+			User:   user.Username,
+			Groups: user.Groups,
+			UID:    user.UID,
+			Extra:  extra,
+		},
+	}
+}
+
+// claimUser returns the name of another CodeServer whose home volume is the home volume of the CodeServer.
+// Without an existing claim, it finds the CodeServer using the PVC named after the CodeServer as its existing claim,
+// which would be adopted and garbage collected with the CodeServer.
+func claimUser(codeServers []CodeServer, codeServer *CodeServer) string {
+	for _, other := range codeServers {
+		if other.Name == codeServer.Name || !other.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if other.HomeClaimName() == codeServer.HomeClaimName() {
+			return other.Name
+		}
+	}
+	return ""
+}
+
+func (r *CodeServer) validateCodeServer() error {
+	var allErrs field.ErrorList
+
+	specPath := field.NewPath("spec")
+	allErrs = append(allErrs, validatePodTemplate(r.Spec.PodTemplate, specPath.Child("podTemplate"))...)
+	allErrs = append(allErrs, validateSecurityContext(r.Spec, specPath)...)
+	allErrs = append(allErrs, validateSidecars(r.Spec, specPath.Child("sidecars"))...)
+	allErrs = append(allErrs, validateExtraVolumes(r.Spec.ExtraVolumes, specPath.Child("extraVolumes"))...)
+	allErrs = append(allErrs, validateSource(r.Name, r.Spec.Source, specPath.Child("source"))...)
+	allErrs = append(allErrs, validateReclaimPolicy(r.Spec, specPath)...)
+	allErrs = append(allErrs, validateTLS(r.Spec.TLS, specPath.Child("tls"))...)
+	allErrs = append(allErrs, validateIngressTemplates(r.Spec, specPath)...)
+	allErrs = append(allErrs, validateRouting(r.Spec, specPath)...)
+	allErrs = append(allErrs, validatePassword(r.Name, r.Spec.Password, specPath.Child("password"))...)
+	allErrs = append(allErrs, validateAuth(r.Spec, specPath)...)
+	allErrs = append(allErrs, validateNetworkPolicy(r.Spec, specPath)...)
+	allErrs = append(allErrs, validatePortDiscovery(r.Spec.PortDiscovery, specPath.Child("portDiscovery"))...)
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+
+	return apierrors.NewInvalid(schema.GroupKind{Group: GroupVersion.Group, Kind: "CodeServer"}, r.Name, allErrs)
+}
+
+func validatePodTemplate(podTemplate *runtime.RawExtension, fldPath *field.Path) field.ErrorList {
+	if podTemplate == nil || len(podTemplate.Raw) == 0 {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+
+	var raw interface{}
+	if err := json.Unmarshal(podTemplate.Raw, &raw); err != nil {
+		return append(allErrs, field.Invalid(fldPath, string(podTemplate.Raw), err.Error()))
+	}
+	if path := findPatchDirective(raw, fldPath); path != nil {
+		allErrs = append(allErrs, field.Forbidden(path, "patch directives are not allowed"))
+	}
+
+	var template corev1.PodTemplateSpec
+	decoder := json.NewDecoder(bytes.NewReader(podTemplate.Raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&template); err != nil {
+		return append(allErrs, field.Invalid(fldPath, string(podTemplate.Raw), err.Error()))
+	}
+
+	for _, key := range reservedPodLabels {
+		if _, ok := template.Labels[key]; ok {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("metadata", "labels").Key(key), "label is managed by the operator"))
+		}
+	}
+
+	specPath := fldPath.Child("spec")
+	for i, volume := range template.Spec.Volumes {
+		if volume.Name == homeVolumeName {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("volumes").Index(i).Child("name"), "home volume cannot be overridden"))
+		}
+	}
+
+	for i, container := range template.Spec.Containers {
+		if container.Name != codeServerContainerName {
+			continue
+		}
+		containerPath := specPath.Child("containers").Index(i)
+		for j, env := range container.Env {
+			if env.Name == passwordEnvName || env.Name == hashedPasswordEnvName {
+				allErrs = append(allErrs, field.Forbidden(containerPath.Child("env").Index(j).Child("name"), "password env cannot be overridden"))
+			}
+		}
+		for j, mount := range container.VolumeMounts {
+			if mount.Name == homeVolumeName || mount.MountPath == homeMountPath {
+				allErrs = append(allErrs, field.Forbidden(containerPath.Child("volumeMounts").Index(j), "home volume mount cannot be overridden"))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+func validateSecurityContext(spec CodeServerSpec, specPath *field.Path) field.ErrorList {
+	sc := spec.SecurityContext
+	if sc == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	fldPath := specPath.Child("securityContext")
+
+	if sc.Profile == SecurityContextProfileCustom {
+		if sc.RunAsUser != nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("runAsUser"), "not used by the custom profile, set pod.runAsUser instead"))
+		}
+		if sc.RunAsGroup != nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("runAsGroup"), "not used by the custom profile, set pod.runAsGroup instead"))
+		}
+		if sc.FSGroup != nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("fsGroup"), "not used by the custom profile, set pod.fsGroup instead"))
+		}
+	} else {
+		if sc.Pod != nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("pod"), "only allowed with the custom profile"))
+		}
+		if sc.Container != nil {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("container"), "only allowed with the custom profile"))
+		}
+	}
+
+	if sc.Profile == SecurityContextProfileRestricted && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("runAsUser"), *sc.RunAsUser, "the restricted profile requires a non-root user"))
+	}
+
+	if forbidsPrivilegeEscalation(sc) {
+		for name := range spec.InitPlugins {
+			if initplugins.RequiresPrivilegeEscalation(name) {
+				allErrs = append(allErrs, field.Forbidden(specPath.Child("initPlugins").Key(name), "plugin requires privilege escalation (sudo), which the security context forbids"))
+			}
+		}
+	}
+
+	return allErrs
+}
+
+func validateSidecars(spec CodeServerSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	names := map[string]bool{codeServerContainerName: true}
+	for i, sidecar := range spec.Sidecars {
+		sidecarPath := fldPath.Index(i)
+
+		if names[sidecar.Name] {
+			allErrs = append(allErrs, field.Duplicate(sidecarPath.Child("name"), sidecar.Name))
+		}
+		names[sidecar.Name] = true
+
+		if sidecar.RestartPolicy != nil && *sidecar.RestartPolicy != corev1.ContainerRestartPolicyAlways {
+			allErrs = append(allErrs, field.NotSupported(sidecarPath.Child("restartPolicy"), *sidecar.RestartPolicy, []string{string(corev1.ContainerRestartPolicyAlways)}))
+		}
+
+		for j, port := range sidecar.Ports {
+			if port.ContainerPort == spec.ContainerPort {
+				allErrs = append(allErrs, field.Invalid(sidecarPath.Child("ports").Index(j).Child("containerPort"), port.ContainerPort, "conflicts with the code server port"))
+			}
+		}
+
+		if sidecar.MountHome {
+			for j, mount := range sidecar.VolumeMounts {
+				if mount.MountPath == homeMountPath {
+					allErrs = append(allErrs, field.Invalid(sidecarPath.Child("volumeMounts").Index(j).Child("mountPath"), mount.MountPath, "conflicts with the home volume mounted by mountHome"))
+				}
+			}
+		}
+	}
+
+	return allErrs
+}
+
+func validateExtraVolumes(extraVolumes []ExtraVolume, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	names := map[string]bool{homeVolumeName: true}
+	mountPaths := map[string]bool{}
+	for i, extraVolume := range extraVolumes {
+		volumePath := fldPath.Index(i)
+
+		if names[extraVolume.Name] {
+			allErrs = append(allErrs, field.Duplicate(volumePath.Child("name"), extraVolume.Name))
+		}
+		names[extraVolume.Name] = true
+
+		mountPath := path.Clean(extraVolume.MountPath)
+		switch {
+		case !path.IsAbs(extraVolume.MountPath):
+			allErrs = append(allErrs, field.Invalid(volumePath.Child("mountPath"), extraVolume.MountPath, "must be an absolute path"))
+		case mountPath == homeMountPath || strings.HasPrefix(homeMountPath, strings.TrimSuffix(mountPath, "/")+"/"):
+			allErrs = append(allErrs, field.Invalid(volumePath.Child("mountPath"), extraVolume.MountPath, "must not shadow "+homeMountPath))
+		case strings.HasPrefix(mountPath, homeMountPath+"/"):
+			// A volume under the home directory shadows a part of the home volume, which the init plugins write.
+			allErrs = append(allErrs, field.Invalid(volumePath.Child("mountPath"), extraVolume.MountPath, "must not be under "+homeMountPath))
+		case mountPaths[mountPath]:
+			allErrs = append(allErrs, field.Duplicate(volumePath.Child("mountPath"), extraVolume.MountPath))
+		}
+		mountPaths[mountPath] = true
+
+		sources := 0
+		for _, specified := range []bool{
+			extraVolume.PersistentVolumeClaim != nil,
+			extraVolume.ConfigMap != nil,
+			extraVolume.Secret != nil,
+			extraVolume.EmptyDir != nil,
+			extraVolume.CSI != nil,
+		} {
+			if specified {
+				sources++
+			}
+		}
+		if sources != 1 {
+			allErrs = append(allErrs, field.Invalid(volumePath, extraVolume.Name, "exactly one volume source must be specified"))
+		}
+	}
+
+	return allErrs
+}
+
+func validateSource(name string, source *CodeServerSource, fldPath *field.Path) field.ErrorList {
+	if source == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	if source.VolumeSnapshotName != "" && source.CodeServerName != "" {
+		allErrs = append(allErrs, field.Invalid(fldPath, source.CodeServerName, "volumeSnapshotName and codeServerName cannot be specified at the same time"))
+	}
+	if source.CodeServerName == name {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("codeServerName"), source.CodeServerName, "must not be the CodeServer itself"))
+	}
+
+	return allErrs
+}
+
+func validateReclaimPolicy(spec CodeServerSpec, specPath *field.Path) field.ErrorList {
+	if spec.ReclaimPolicy != ReclaimPolicyArchive {
+		return nil
+	}
+
+	archivePath := specPath.Child("archive")
+	if spec.Archive == nil {
+		return field.ErrorList{field.Required(archivePath, "archive is required with the Archive reclaim policy")}
+	}
+
+	var allErrs field.ErrorList
+	if spec.Archive.Bucket == "" {
+		allErrs = append(allErrs, field.Required(archivePath.Child("bucket"), ""))
+	}
+	if spec.Archive.CredentialsSecretName == "" {
+		allErrs = append(allErrs, field.Required(archivePath.Child("credentialsSecretName"), ""))
+	}
+	if spec.Archive.Endpoint != "" {
+		if u, err := url.Parse(spec.Archive.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			allErrs = append(allErrs, field.Invalid(archivePath.Child("endpoint"), spec.Archive.Endpoint, "must be an http or https URL"))
+		}
+	}
+
+	return allErrs
+}
+
+func validateTLS(tls *IngressTLS, fldPath *field.Path) field.ErrorList {
+	if tls == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	if _, err := template.New("secretName").Parse(tls.SecretName); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("secretName"), tls.SecretName, err.Error()))
+	}
+	if tls.ClusterIssuer != "" && tls.Issuer != "" {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("issuer"), tls.Issuer, "clusterIssuer and issuer cannot be specified at the same time"))
+	}
+	if tls.WildcardSecretName != "" && (tls.ClusterIssuer != "" || tls.Issuer != "") {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("wildcardSecretName"), tls.WildcardSecretName, "an issuer cannot be specified with a wildcard secret"))
+	}
+
+	return allErrs
+}
+
+func validateRouting(spec CodeServerSpec, specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if spec.Routing == RoutingHTTPRoute && spec.Gateway == nil {
+		allErrs = append(allErrs, field.Required(specPath.Child("gateway"), "gateway is required if routing is HTTPRoute"))
+	}
+	if spec.Routing == RoutingHTTPRoute && len(spec.PublicProxyPorts) > MaxProxyPorts {
+		allErrs = append(allErrs, field.TooMany(specPath.Child("publicProxyPorts"), len(spec.PublicProxyPorts), MaxProxyPorts))
+	}
+	return allErrs
+}
+
+func validateAuth(spec CodeServerSpec, specPath *field.Path) field.ErrorList {
+	auth := spec.Auth
+	if auth == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	fldPath := specPath.Child("auth")
+	switch auth.Mode {
+	case AuthModeOAuth2Proxy:
+		if auth.OAuth2Proxy == nil {
+			return append(allErrs, field.Required(fldPath.Child("oauth2Proxy"), "oauth2Proxy is required if mode is OAuth2Proxy"))
+		}
+		if u, err := url.Parse(auth.OAuth2Proxy.IssuerURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("oauth2Proxy", "issuerURL"), auth.OAuth2Proxy.IssuerURL, "must be an http or https URL"))
+		}
+		if auth.OAuth2Proxy.Port == spec.ContainerPort {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("oauth2Proxy", "port"), auth.OAuth2Proxy.Port, "must be different from containerPort"))
+		}
+		if spec.PathPrefixTemplate != "" {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("mode"), "OAuth2Proxy cannot be used with pathPrefixTemplate"))
+		}
+	case AuthModeForwardAuth:
+		if auth.ForwardAuth == nil {
+			return append(allErrs, field.Required(fldPath.Child("forwardAuth"), "forwardAuth is required if mode is ForwardAuth"))
+		}
+		if u, err := url.Parse(auth.ForwardAuth.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("forwardAuth", "url"), auth.ForwardAuth.URL, "must be an http or https URL"))
+		}
+		if spec.Exposure != "" && spec.Exposure != ExposureIngress {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("mode"), fmt.Sprintf("ForwardAuth cannot be used with %s exposure", spec.Exposure)))
+		}
+		if spec.Routing == RoutingHTTPRoute {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("mode"), "ForwardAuth cannot be used with HTTPRoute routing"))
+		}
+	}
+	return allErrs
+}
+
+func validatePassword(name string, password *CodeServerPassword, fldPath *field.Path) field.ErrorList {
+	if password == nil || password.SecretName == "" {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	if password.SecretName == name {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("secretName"), password.SecretName, "secret of the CodeServer is managed by the operator"))
+	}
+	if password.RotationIntervalSeconds != nil {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("rotationIntervalSeconds"), "password in an existing secret cannot be rotated"))
+	}
+	return allErrs
+}
+
+func validateNetworkPolicy(spec CodeServerSpec, specPath *field.Path) field.ErrorList {
+	policy := spec.NetworkPolicy
+	if policy == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	fldPath := specPath.Child("networkPolicy")
+	if spec.Exposure == ExposureNodePort || spec.Exposure == ExposureLoadBalancer {
+		allErrs = append(allErrs, field.Forbidden(fldPath, fmt.Sprintf("networkPolicy only allows the ingress controller, which cannot be used with %s exposure", spec.Exposure)))
+	}
+	if policy.Egress == EgressPolicyAllowlist || policy.Egress == EgressPolicyNone {
+		if spec.Auth != nil && spec.Auth.Mode == AuthModeOAuth2Proxy {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("egress"), "egress must be Open for oauth2-proxy to reach the OIDC issuer"))
+		}
+		if _, ok := spec.InitPlugins["git"]; ok {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("egress"), "egress must be Open for the git init plugin to clone the repository"))
+		}
+	}
+	for i, cidr := range policy.EgressCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("egressCIDRs").Index(i), cidr, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+func validatePortDiscovery(discovery *PortDiscovery, fldPath *field.Path) field.ErrorList {
+	if discovery == nil {
+		return nil
+	}
+
+	var allErrs field.ErrorList
+	validateRanges := func(ranges []PortRange, fldPath *field.Path) {
+		for i, r := range ranges {
+			if r.End != 0 && r.End < r.Start {
+				allErrs = append(allErrs, field.Invalid(fldPath.Index(i).Child("end"), r.End, "must be greater than or equal to start"))
+			}
+		}
+	}
+	validateRanges(discovery.Allow, fldPath.Child("allow"))
+	validateRanges(discovery.Deny, fldPath.Child("deny"))
+	return allErrs
+}
+
+func validateIngressTemplates(spec CodeServerSpec, specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if _, err := template.New("hostTemplate").Parse(spec.HostTemplate); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("hostTemplate"), spec.HostTemplate, err.Error()))
+	}
+	if _, err := template.New("pathPrefixTemplate").Parse(spec.PathPrefixTemplate); err != nil {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("pathPrefixTemplate"), spec.PathPrefixTemplate, err.Error()))
+	} else if spec.PathPrefixTemplate != "" && !strings.HasPrefix(spec.PathPrefixTemplate, "/") {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("pathPrefixTemplate"), spec.PathPrefixTemplate, "must start with /"))
+	}
+	if spec.ProxyMode == ProxyModeSubdomain && spec.PathPrefixTemplate != "" {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("proxyMode"), "Subdomain cannot be used with pathPrefixTemplate"))
+	}
+	return allErrs
+}
+
+// forbidsPrivilegeEscalation reports whether the security context prevents sudo from working in containers.
+func forbidsPrivilegeEscalation(sc *CodeServerSecurityContext) bool {
+	switch sc.Profile {
+	case SecurityContextProfileRestricted:
+		return true
+	case SecurityContextProfileCustom:
+		if sc.Container == nil {
+			return false
+		}
+		if sc.Container.AllowPrivilegeEscalation != nil && !*sc.Container.AllowPrivilegeEscalation {
+			return true
+		}
+		if sc.Container.Capabilities != nil {
+			for _, c := range sc.Container.Capabilities.Drop {
+				if c == "ALL" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// findPatchDirective returns the path of the first strategic merge patch directive (e.g. $patch) in obj.
+func findPatchDirective(obj interface{}, fldPath *field.Path) *field.Path {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if strings.HasPrefix(key, "$") {
+				return fldPath.Child(key)
+			}
+			if path := findPatchDirective(value, fldPath.Child(key)); path != nil {
+				return path
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			if path := findPatchDirective(value, fldPath.Index(i)); path != nil {
+				return path
+			}
+		}
+	}
+	return nil
+}
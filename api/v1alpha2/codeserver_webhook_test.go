@@ -17,7 +17,22 @@ limitations under the License.
 package v1alpha2
 
 import (
+	"context"
+
 	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 var _ = Describe("CodeServer Webhook", func() {
@@ -31,16 +46,533 @@ var _ = Describe("CodeServer Webhook", func() {
 	})
 
 	Context("When creating CodeServer under Validating Webhook", func() {
-		It("Should deny if a required field is empty", func() {
+		It("Should admit if podTemplate is not specified", func() {
+			codeServer := &CodeServer{}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
 
-			// TODO(user): Add your logic here
+		It("Should admit if podTemplate adds sidecars, volumes and probes", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					PodTemplate: &runtime.RawExtension{Raw: []byte(`{
+						"metadata": {"annotations": {"example.com/team": "a"}},
+						"spec": {
+							"containers": [
+								{"name": "code-server", "readinessProbe": {"httpGet": {"path": "/healthz", "port": 19200}}},
+								{"name": "redis", "image": "redis"}
+							],
+							"volumes": [{"name": "scratch", "emptyDir": {}}]
+						}
+					}`)},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
 
+		It("Should deny if podTemplate overrides the home volume", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					PodTemplate: &runtime.RawExtension{Raw: []byte(`{"spec": {"volumes": [{"name": "home", "emptyDir": {}}]}}`)},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
 		})
 
-		It("Should admit if all required fields are provided", func() {
+		It("Should deny if podTemplate overrides the password env", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					PodTemplate: &runtime.RawExtension{Raw: []byte(`{"spec": {"containers": [{"name": "code-server", "env": [{"name": "PASSWORD", "value": "x"}]}]}}`)},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
 
-			// TODO(user): Add your logic here
+		It("Should deny if podTemplate contains patch directives", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					PodTemplate: &runtime.RawExtension{Raw: []byte(`{"spec": {"containers": [{"$patch": "replace"}]}}`)},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny if podTemplate contains unknown fields", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					PodTemplate: &runtime.RawExtension{Raw: []byte(`{"spec": {"sidecars": []}}`)},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should admit if the restricted profile is used without privileged plugins", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					InitPlugins: map[string]map[string]string{
+						"copyDefaultConfig": {},
+					},
+					SecurityContext: &CodeServerSecurityContext{
+						Profile: SecurityContextProfileRestricted,
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny if the restricted profile is used with copyHome", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					InitPlugins: map[string]map[string]string{
+						"copyHome": {},
+					},
+					SecurityContext: &CodeServerSecurityContext{
+						Profile: SecurityContextProfileRestricted,
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny if a custom container security context is used without the custom profile", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					SecurityContext: &CodeServerSecurityContext{
+						Profile:   SecurityContextProfileBaseline,
+						Container: &corev1.SecurityContext{},
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny if a sidecar uses the code server container name", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					Sidecars: []Sidecar{
+						{Container: corev1.Container{Name: "code-server", Image: "redis"}},
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should admit native sidecars sharing the home volume", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					ContainerPort: 19200,
+					Sidecars: []Sidecar{
+						{
+							Container: corev1.Container{
+								Name:          "language-server",
+								Image:         "example.com/language-server",
+								RestartPolicy: ptr.To(corev1.ContainerRestartPolicyAlways),
+								Ports:         []corev1.ContainerPort{{ContainerPort: 8080}},
+							},
+							MountHome: true,
+						},
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should admit a read-only dataset and a scratch directory", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					ExtraVolumes: []ExtraVolume{
+						{
+							Name:                  "dataset",
+							MountPath:             "/data",
+							ReadOnly:              true,
+							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "dataset", ReadOnly: true},
+						},
+						{
+							Name:      "scratch",
+							MountPath: "/scratch",
+							EmptyDir:  &corev1.EmptyDirVolumeSource{},
+						},
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny if an extra volume shadows the home directory", func() {
+			for _, mountPath := range []string{"/home/coder", "/home", "/", "/home/coder/scratch", "/home/coder/work/"} {
+				codeServer := &CodeServer{
+					Spec: CodeServerSpec{
+						ExtraVolumes: []ExtraVolume{
+							{Name: "scratch", MountPath: mountPath, EmptyDir: &corev1.EmptyDirVolumeSource{}},
+						},
+					},
+				}
+				_, err := codeServer.ValidateCreate()
+				Expect(err).To(HaveOccurred(), mountPath)
+			}
+		})
+
+		It("Should deny if an extra volume has no or multiple volume sources", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					ExtraVolumes: []ExtraVolume{
+						{Name: "none", MountPath: "/none"},
+						{
+							Name:      "both",
+							MountPath: "/both",
+							EmptyDir:  &corev1.EmptyDirVolumeSource{},
+							ConfigMap: &corev1.ConfigMapVolumeSource{},
+						},
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny if the source is both a snapshot and a CodeServer", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					Source: &CodeServerSource{VolumeSnapshotName: "backup", CodeServerName: "mentor"},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny if the source is the CodeServer itself", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					Source: &CodeServerSource{CodeServerName: "mentee"},
+				},
+			}
+			codeServer.Name = "mentee"
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny if the Archive reclaim policy is used without a bucket", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					ReclaimPolicy: ReclaimPolicyArchive,
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.Archive = &ArchiveSpec{Endpoint: "minio:9000", Bucket: "workspaces", CredentialsSecretName: "minio"}
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.Archive.Endpoint = "http://minio.minio.svc:9000"
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should find another CodeServer using the existing claim", func() {
+			codeServer := &CodeServer{Spec: CodeServerSpec{ExistingClaim: "migrated"}}
+			codeServer.Name = "new"
+
+			owner := CodeServer{}
+			owner.Name = "migrated"
+			adopter := CodeServer{Spec: CodeServerSpec{ExistingClaim: "migrated"}}
+			adopter.Name = "adopter"
+			deleting := CodeServer{Spec: CodeServerSpec{ExistingClaim: "migrated"}}
+			deleting.Name = "deleting"
+			deleting.DeletionTimestamp = ptr.To(metav1.Now())
+
+			Expect(claimUser([]CodeServer{*codeServer, deleting}, codeServer)).To(BeEmpty())
+			Expect(claimUser([]CodeServer{*codeServer, owner}, codeServer)).To(Equal("migrated"))
+			Expect(claimUser([]CodeServer{*codeServer, adopter}, codeServer)).To(Equal("adopter"))
+		})
+
+		It("Should find another CodeServer using the PVC named after the CodeServer as its existing claim", func() {
+			codeServer := &CodeServer{}
+			codeServer.Name = "a"
+
+			adopter := CodeServer{Spec: CodeServerSpec{ExistingClaim: "a"}}
+			adopter.Name = "b"
+			other := CodeServer{Spec: CodeServerSpec{ExistingClaim: "c"}}
+			other.Name = "d"
+
+			Expect(claimUser([]CodeServer{*codeServer, other}, codeServer)).To(BeEmpty())
+			Expect(claimUser([]CodeServer{*codeServer, adopter}, codeServer)).To(Equal("b"))
+		})
+
+		It("Should deny the owner to be granted a password secret the user cannot get", func() {
+			scheme := runtime.NewScheme()
+			Expect(authorizationv1.AddToScheme(scheme)).To(Succeed())
+			var reviews []authorizationv1.SubjectAccessReviewSpec
+			v := &codeServerValidator{client: fake.NewClientBuilder().WithScheme(scheme).WithInterceptorFuncs(interceptor.Funcs{
+				Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+					review := obj.(*authorizationv1.SubjectAccessReview)
+					reviews = append(reviews, review.Spec)
+					review.Status.Allowed = review.Spec.User == "admin"
+					return nil
+				},
+			}).Build()}
+			codeServer := &CodeServer{Spec: CodeServerSpec{
+				Owner:    &CodeServerOwner{Name: "alice"},
+				Password: &CodeServerPassword{SecretName: "team-secrets"},
+			}}
+			codeServer.Name = "alice"
+			codeServer.Namespace = "team-a"
+			requestBy := func(username string) context.Context {
+				return admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+					UserInfo: authenticationv1.UserInfo{Username: username, Groups: []string{"developers"}},
+				}})
+			}
+
+			Expect(v.validatePasswordSecret(requestBy("admin"), codeServer)).To(Succeed())
+			Expect(reviews).To(HaveLen(1))
+			Expect(reviews[0].Groups).To(Equal([]string{"developers"}))
+			Expect(*reviews[0].ResourceAttributes).To(Equal(authorizationv1.ResourceAttributes{
+				Namespace: "team-a",
+				Verb:      "get",
+				Resource:  "secrets",
+				Name:      "team-secrets",
+			}))
+
+			err := v.validatePasswordSecret(requestBy("alice"), codeServer)
+			Expect(apierrors.IsInvalid(err)).To(BeTrue())
+
+			codeServer.Spec.Owner = nil
+			Expect(v.validatePasswordSecret(requestBy("alice"), codeServer)).To(Succeed())
+			Expect(reviews).To(HaveLen(2))
+		})
+
+		It("Should deny if both an issuer and a wildcard secret are used for TLS", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					TLS: &IngressTLS{SecretName: "{{ .Name }}-tls", WildcardSecretName: "wildcard-tls", ClusterIssuer: "letsencrypt"},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.TLS.WildcardSecretName = ""
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+
+			codeServer.Spec.TLS.SecretName = "{{ .Name "
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny HTTPRoute routing without a gateway", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{Routing: RoutingHTTPRoute},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.Gateway = &GatewayReference{Name: "shared", Namespace: "gateway"}
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny more proxy ports than HTTPRoute can route", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					Routing: RoutingHTTPRoute,
+					Gateway: &GatewayReference{Name: "shared", Namespace: "gateway"},
+				},
+			}
+			for port := int32(3000); port < 3000+MaxProxyPorts; port++ {
+				codeServer.Spec.PublicProxyPorts = append(codeServer.Spec.PublicProxyPorts, port)
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+
+			codeServer.Spec.PublicProxyPorts = append(codeServer.Spec.PublicProxyPorts, 4000)
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny an incomplete auth", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					ContainerPort: 19200,
+					Auth:          &CodeServerAuth{Mode: AuthModeOAuth2Proxy},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.Auth.OAuth2Proxy = &OAuth2Proxy{IssuerURL: "http://mock-oidc.default.svc:8080/default", ClientID: "code-server", ClientSecretName: "oidc", Port: 4180}
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+
+			codeServer.Spec.Auth = &CodeServerAuth{Mode: AuthModeForwardAuth, ForwardAuth: &ForwardAuth{URL: "https://oauth2-proxy.example.com/oauth2/auth"}}
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+
+			codeServer.Spec.Routing = RoutingHTTPRoute
+			codeServer.Spec.Gateway = &GatewayReference{Name: "shared"}
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		DescribeTable("Should deny ForwardAuth without an Ingress",
+			func(exposure Exposure, valid bool) {
+				codeServer := &CodeServer{
+					Spec: CodeServerSpec{
+						Exposure: exposure,
+						Auth:     &CodeServerAuth{Mode: AuthModeForwardAuth, ForwardAuth: &ForwardAuth{URL: "https://oauth2-proxy.example.com/oauth2/auth"}},
+					},
+				}
+				_, err := codeServer.ValidateCreate()
+				if valid {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(HaveOccurred())
+				}
+			},
+			Entry("Ingress", ExposureIngress, true),
+			Entry("None", ExposureNone, false),
+			Entry("NodePort", ExposureNodePort, false),
+			Entry("LoadBalancer", ExposureLoadBalancer, false),
+		)
+
+		It("Should deny rotating the password in an existing secret", func() {
+			codeServer := &CodeServer{
+				ObjectMeta: metav1.ObjectMeta{Name: "alice"},
+				Spec: CodeServerSpec{
+					Password: &CodeServerPassword{
+						SecretName:              "alice-password",
+						RotationIntervalSeconds: ptr.To[int64](86400),
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.Password.RotationIntervalSeconds = nil
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+
+			codeServer.Spec.Password.SecretName = "alice"
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny an invalid egress CIDR", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					NetworkPolicy: &CodeServerNetworkPolicy{
+						Egress:      EgressPolicyAllowlist,
+						EgressCIDRs: []string{"10.0.0.0/8", "192.168.0.1"},
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.NetworkPolicy.EgressCIDRs[1] = "192.168.0.1/32"
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		DescribeTable("Should deny the network policy blocking the required traffic",
+			func(spec CodeServerSpec) {
+				codeServer := &CodeServer{Spec: spec}
+				_, err := codeServer.ValidateCreate()
+				Expect(err).NotTo(HaveOccurred())
+
+				codeServer.Spec.NetworkPolicy = &CodeServerNetworkPolicy{Egress: EgressPolicyAllowlist, EgressCIDRs: []string{"10.0.0.0/8"}}
+				_, err = codeServer.ValidateCreate()
+				Expect(err).To(HaveOccurred())
+
+				codeServer.Spec.NetworkPolicy.Egress = EgressPolicyNone
+				_, err = codeServer.ValidateCreate()
+				Expect(err).To(HaveOccurred())
+			},
+			Entry("NodePort exposure", CodeServerSpec{Exposure: ExposureNodePort}),
+			Entry("LoadBalancer exposure", CodeServerSpec{Exposure: ExposureLoadBalancer}),
+			Entry("oauth2-proxy reaching the OIDC issuer", CodeServerSpec{
+				Auth: &CodeServerAuth{
+					Mode:        AuthModeOAuth2Proxy,
+					OAuth2Proxy: &OAuth2Proxy{IssuerURL: "https://accounts.example.com", Port: 4180},
+				},
+			}),
+			Entry("git init plugin cloning the repository", CodeServerSpec{
+				InitPlugins: map[string]map[string]string{"git": {"repourl": "https://github.com/walnuts1018/code-server-operator"}},
+			}),
+		)
+
+		It("Should allow the network policy with open egress", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					Auth: &CodeServerAuth{
+						Mode:        AuthModeOAuth2Proxy,
+						OAuth2Proxy: &OAuth2Proxy{IssuerURL: "https://accounts.example.com", Port: 4180},
+					},
+					InitPlugins:   map[string]map[string]string{"git": {"repourl": "https://github.com/walnuts1018/code-server-operator"}},
+					NetworkPolicy: &CodeServerNetworkPolicy{Egress: EgressPolicyOpen},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+
+			codeServer.Spec.Exposure = ExposureLoadBalancer
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny a port range ending before its start", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					PortDiscovery: &PortDiscovery{
+						Allow: []PortRange{{Start: 3000, End: 9999}, {Start: 5173}},
+						Deny:  []PortRange{{Start: 8080, End: 8000}},
+					},
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.PortDiscovery.Deny[0].End = 8090
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should deny invalid ingress templates", func() {
+			codeServer := &CodeServer{
+				Spec: CodeServerSpec{
+					HostTemplate:       "code.{{ .Domain }}",
+					PathPrefixTemplate: "/{{ .Namespace }}/{{ .Name }}",
+				},
+			}
+			_, err := codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
+
+			codeServer.Spec.PathPrefixTemplate = "{{ .Name }}"
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.PathPrefixTemplate = "/{{ .Name }}"
+			codeServer.Spec.ProxyMode = ProxyModeSubdomain
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
+
+			codeServer.Spec.PathPrefixTemplate = ""
+			_, err = codeServer.ValidateCreate()
+			Expect(err).NotTo(HaveOccurred())
 
+			codeServer.Spec.HostTemplate = "{{ .Name "
+			_, err = codeServer.ValidateCreate()
+			Expect(err).To(HaveOccurred())
 		})
 	})
 
@@ -30,6 +30,11 @@ type CodeServerDeploymentSpec struct {
 
 	Template CodeServersTemplate `json:"template"`
 	Replicas int32               `json:"replicas"`
+
+	// Owners specifies the owners of the replicas, one per replica, overriding the owner of the template.
+	// The owner of a replica is never changed: the replica of an owner removed from Owners is deleted,
+	// and a new replica is created for a new owner. The replicas beyond Owners have the owner of the template.
+	Owners []CodeServerOwner `json:"owners,omitempty"`
 }
 
 type CodeServersTemplate struct {
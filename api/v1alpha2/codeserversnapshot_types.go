@@ -0,0 +1,103 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha2
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CodeServerSnapshotSpec defines the desired state of CodeServerSnapshot
+type CodeServerSnapshotSpec struct {
+	// CodeServerName is the name of the CodeServer in the same namespace whose home volume is snapshotted.
+	CodeServerName string `json:"codeServerName"`
+
+	// VolumeSnapshotClassName is the name of the VolumeSnapshotClass. The default class is used if not specified.
+	VolumeSnapshotClassName *string `json:"volumeSnapshotClassName,omitempty"`
+
+	// Schedule in Cron format, e.g. "0 3 * * *", for periodic snapshots.
+	// A single snapshot is taken if not specified.
+	Schedule string `json:"schedule,omitempty"`
+
+	// RetentionCount is the number of scheduled snapshots to keep, defaults in 3.
+	// The oldest snapshots are deleted first.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:default=3
+	RetentionCount int32 `json:"retentionCount,omitempty"`
+}
+
+const (
+	// ConditionTypeSnapshotReady indicates whether the latest VolumeSnapshot is ready to use.
+	ConditionTypeSnapshotReady = "SnapshotReady"
+)
+
+// CodeServerSnapshotStatus defines the observed state of CodeServerSnapshot
+type CodeServerSnapshotStatus struct {
+	// Snapshots are the VolumeSnapshots taken, oldest first.
+	Snapshots []VolumeSnapshotStatus `json:"snapshots,omitempty"`
+
+	// LastSnapshotTime is the time when the latest VolumeSnapshot was created.
+	LastSnapshotTime *metav1.Time `json:"lastSnapshotTime,omitempty"`
+
+	// NextSnapshotTime is the time when the next scheduled VolumeSnapshot will be created.
+	NextSnapshotTime *metav1.Time `json:"nextSnapshotTime,omitempty"`
+
+	// Conditions represent the latest available observations of CodeServerSnapshot.
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// VolumeSnapshotStatus defines the observed state of a VolumeSnapshot
+type VolumeSnapshotStatus struct {
+	// Name of the VolumeSnapshot, which can be used as the source of a new CodeServer.
+	Name string `json:"name"`
+
+	// CreationTime is the time when the VolumeSnapshot was created.
+	CreationTime metav1.Time `json:"creationTime"`
+
+	// ReadyToUse indicates whether the VolumeSnapshot can be restored.
+	ReadyToUse bool `json:"readyToUse,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="CODESERVER",type="string",JSONPath=".spec.codeServerName",description="Snapshotted CodeServer"
+//+kubebuilder:printcolumn:name="SCHEDULE",type="string",JSONPath=".spec.schedule",description="Snapshot schedule"
+//+kubebuilder:printcolumn:name="LAST SNAPSHOT",type="date",JSONPath=".status.lastSnapshotTime",description="Time of the latest snapshot"
+//+kubebuilder:printcolumn:name="AGE",type="date",JSONPath=".metadata.creationTimestamp"
+
+// CodeServerSnapshot is the Schema for the codeserversnapshots API
+type CodeServerSnapshot struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CodeServerSnapshotSpec   `json:"spec,omitempty"`
+	Status CodeServerSnapshotStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// CodeServerSnapshotList contains a list of CodeServerSnapshot
+type CodeServerSnapshotList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CodeServerSnapshot `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CodeServerSnapshot{}, &CodeServerSnapshotList{})
+}
@@ -25,17 +25,25 @@ import (
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
 	"github.com/walnuts1018/code-server-operator/internal/controller"
+	"github.com/walnuts1018/code-server-operator/internal/metrics"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -49,6 +57,8 @@ func init() {
 
 	utilruntime.Must(csv1alpha2.AddToScheme(scheme))
 	utilruntime.Must(csv1alpha2.AddToScheme(scheme))
+	utilruntime.Must(snapshotv1.AddToScheme(scheme))
+	utilruntime.Must(gatewayv1.Install(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
@@ -97,6 +107,14 @@ func main() {
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme: scheme,
+		// Only the pods of code server are watched and listed, so the other pods in the cluster are not cached.
+		Cache: cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Pod{}: {
+					Label: labels.SelectorFromSet(labels.Set{"app.kubernetes.io/created-by": controller.CodeServerManager}),
+				},
+			},
+		},
 		Metrics: metricsserver.Options{
 			BindAddress:   metricsAddr,
 			SecureServing: secureMetrics,
@@ -123,9 +141,21 @@ func main() {
 		os.Exit(1)
 	}
 
+	gatewayAvailable, err := controller.GatewayAvailable(mgr.GetRESTMapper())
+	if err != nil {
+		setupLog.Error(err, "unable to discover Gateway API")
+		os.Exit(1)
+	}
+	if !gatewayAvailable {
+		setupLog.Info("Gateway API CRDs are not installed, HTTPRoute routing is disabled")
+	}
+
 	if err = (&controller.CodeServerReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		Recorder:          mgr.GetEventRecorderFor("codeserver-controller"),
+		GatewayAvailable:  gatewayAvailable,
+		OperatorNamespace: os.Getenv("POD_NAMESPACE"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CodeServer")
 		os.Exit(1)
@@ -137,14 +167,33 @@ func main() {
 		}
 	}
 	if err = (&controller.CodeServerDeploymentReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("codeserverdeployment-controller"),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "CodeServerDeployment")
 		os.Exit(1)
 	}
+	snapshotAvailable, err := controller.VolumeSnapshotAvailable(mgr.GetRESTMapper())
+	if err != nil {
+		setupLog.Error(err, "unable to discover VolumeSnapshot API")
+		os.Exit(1)
+	}
+	if snapshotAvailable {
+		if err = (&controller.CodeServerSnapshotReconciler{
+			Client: mgr.GetClient(),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CodeServerSnapshot")
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("VolumeSnapshot CRDs are not installed, disabling controller", "controller", "CodeServerSnapshot")
+	}
 	//+kubebuilder:scaffold:builder
 
+	ctrlmetrics.Registry.MustRegister(metrics.NewCollector(mgr.GetClient()))
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -0,0 +1,186 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+const (
+	// CookieSecretKey is the key of the secret of the CodeServer holding the cookie secret of oauth2-proxy.
+	CookieSecretKey = "cookie-secret"
+	// AuthenticatedEmailsKey is the key of the secret of the CodeServer holding AllowedEmails, one per line.
+	AuthenticatedEmailsKey = "authenticated-emails"
+
+	oauth2ProxyVolumeName = "oauth2-proxy"
+	oauth2ProxyMountPath  = "/etc/oauth2-proxy"
+)
+
+// authMode returns the authentication mode of code server.
+func authMode(codeServer csv1alpha2.CodeServer) csv1alpha2.AuthMode {
+	if codeServer.Spec.Auth == nil || codeServer.Spec.Auth.Mode == "" {
+		return csv1alpha2.AuthModePassword
+	}
+	return codeServer.Spec.Auth.Mode
+}
+
+// servicePort returns the port of code server pod the http port of the service targets,
+// which is oauth2-proxy if it authenticates the users.
+func servicePort(codeServer csv1alpha2.CodeServer) int32 {
+	if authMode(codeServer) == csv1alpha2.AuthModeOAuth2Proxy {
+		return codeServer.Spec.Auth.OAuth2Proxy.Port
+	}
+	return codeServer.Spec.ContainerPort
+}
+
+// bindAddress returns the address code server listens on, which is localhost if oauth2-proxy authenticates the users
+// so that the requests to the pod IP cannot bypass oauth2-proxy.
+func bindAddress(codeServer csv1alpha2.CodeServer) string {
+	if authMode(codeServer) == csv1alpha2.AuthModeOAuth2Proxy {
+		return "127.0.0.1"
+	}
+	return "0.0.0.0"
+}
+
+// probePort returns the port the default probes of code server connect to. The kubelet cannot reach code server
+// listening on localhost, so it is probed through oauth2-proxy, which skips the authentication of /healthz.
+func probePort(codeServer csv1alpha2.CodeServer) intstr.IntOrString {
+	if authMode(codeServer) == csv1alpha2.AuthModeOAuth2Proxy {
+		return intstr.FromInt32(codeServer.Spec.Auth.OAuth2Proxy.Port)
+	}
+	return intstr.FromString("http")
+}
+
+// oauth2ProxyContainer returns the oauth2-proxy sidecar proxying the authenticated requests to code server,
+// and the volume of the authenticated emails file.
+func oauth2ProxyContainer(codeServer csv1alpha2.CodeServer) (*corev1apply.ContainerApplyConfiguration, *corev1apply.VolumeApplyConfiguration) {
+	auth := codeServer.Spec.Auth
+	proxy := auth.OAuth2Proxy
+
+	args := []string{
+		fmt.Sprintf("--http-address=0.0.0.0:%d", proxy.Port),
+		fmt.Sprintf("--upstream=http://127.0.0.1:%d/", codeServer.Spec.ContainerPort),
+		"--provider=oidc",
+		"--oidc-issuer-url=" + proxy.IssuerURL,
+		"--client-id=" + proxy.ClientID,
+		"--reverse-proxy=true",
+		"--skip-provider-button=true",
+		"--skip-auth-route=^/healthz$",
+		"--cookie-secure=" + strconv.FormatBool(codeServer.Spec.TLS != nil),
+	}
+	if len(auth.AllowedEmails) > 0 {
+		args = append(args, fmt.Sprintf("--authenticated-emails-file=%s/%s", oauth2ProxyMountPath, AuthenticatedEmailsKey))
+	} else {
+		args = append(args, "--email-domain=*")
+	}
+	for _, group := range auth.AllowedGroups {
+		args = append(args, "--allowed-group="+group)
+	}
+	args = append(args, proxy.ExtraArgs...)
+
+	container := corev1apply.Container().
+		WithName("oauth2-proxy").
+		WithImage(proxy.Image).
+		WithArgs(args...).
+		WithPorts(corev1apply.ContainerPort().
+			WithName("oauth2-proxy").
+			WithProtocol(corev1.ProtocolTCP).
+			WithContainerPort(proxy.Port),
+		).
+		WithEnv(
+			corev1apply.EnvVar().
+				WithName("OAUTH2_PROXY_CLIENT_SECRET").
+				WithValueFrom(corev1apply.EnvVarSource().
+					WithSecretKeyRef(corev1apply.SecretKeySelector().
+						WithName(proxy.ClientSecretName).
+						WithKey("client-secret"),
+					),
+				),
+			corev1apply.EnvVar().
+				WithName("OAUTH2_PROXY_COOKIE_SECRET").
+				WithValueFrom(corev1apply.EnvVarSource().
+					WithSecretKeyRef(corev1apply.SecretKeySelector().
+						WithName(codeServer.Name).
+						WithKey(CookieSecretKey),
+					),
+				),
+		).
+		WithReadinessProbe(corev1apply.Probe().
+			WithHTTPGet(corev1apply.HTTPGetAction().
+				WithPath("/ready").
+				WithPort(intstr.FromInt32(proxy.Port)),
+			),
+		)
+
+	if len(auth.AllowedEmails) == 0 {
+		return container, nil
+	}
+
+	container.WithVolumeMounts(corev1apply.VolumeMount().
+		WithName(oauth2ProxyVolumeName).
+		WithMountPath(oauth2ProxyMountPath).
+		WithReadOnly(true),
+	)
+	volume := corev1apply.Volume().
+		WithName(oauth2ProxyVolumeName).
+		WithSecret(corev1apply.SecretVolumeSource().
+			WithSecretName(codeServer.Name).
+			WithItems(corev1apply.KeyToPath().
+				WithKey(AuthenticatedEmailsKey).
+				WithPath(AuthenticatedEmailsKey),
+			),
+		)
+	return container, volume
+}
+
+// forwardAuthAnnotations returns the ingress-nginx annotations authenticating the requests with ForwardAuth.
+func forwardAuthAnnotations(codeServer csv1alpha2.CodeServer) (map[string]string, error) {
+	auth := codeServer.Spec.Auth
+	forwardAuth := auth.ForwardAuth
+
+	authURL, err := url.Parse(forwardAuth.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse forward auth URL: %w", err)
+	}
+	query := authURL.Query()
+	if len(auth.AllowedEmails) > 0 {
+		query.Set("allowed_emails", strings.Join(auth.AllowedEmails, ","))
+	}
+	if len(auth.AllowedGroups) > 0 {
+		query.Set("allowed_groups", strings.Join(auth.AllowedGroups, ","))
+	}
+	authURL.RawQuery = query.Encode()
+
+	annotations := map[string]string{
+		"nginx.ingress.kubernetes.io/auth-url": authURL.String(),
+	}
+	if forwardAuth.SignInURL != "" {
+		annotations["nginx.ingress.kubernetes.io/auth-signin"] = forwardAuth.SignInURL
+	}
+	if len(forwardAuth.ResponseHeaders) > 0 {
+		annotations["nginx.ingress.kubernetes.io/auth-response-headers"] = strings.Join(forwardAuth.ResponseHeaders, ",")
+	}
+	return annotations, nil
+}
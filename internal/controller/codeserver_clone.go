@@ -0,0 +1,322 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	batchv1apply "k8s.io/client-go/applyconfigurations/batch/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// CopySourceAnnotationKey is the PVC annotation that records the source PVC whose files have not been copied yet.
+	CopySourceAnnotationKey = "cs.walnuts.dev/copy-source"
+	// VolumeCloneAnnotationKey is the StorageClass annotation that tells its CSI driver supports volume cloning.
+	// Many CSI drivers do not support it, and a PVC cloned by them stays pending forever.
+	VolumeCloneAnnotationKey = "cs.walnuts.dev/volume-clone"
+)
+
+// populatePVC sets the data source of a new PVC from the source of the CodeServer.
+// If the home volume of the source CodeServer cannot be cloned by the CSI driver,
+// the PVC is annotated with CopySourceAnnotationKey to be populated by a copy Job instead.
+func (r *CodeServerReconciler) populatePVC(ctx context.Context, pvc *corev1.PersistentVolumeClaim, source csv1alpha2.CodeServerSource) error {
+	switch {
+	case source.VolumeSnapshotName != "":
+		pvc.Spec.DataSourceRef = &corev1.TypedObjectReference{
+			APIGroup: ptr.To(snapshotv1.GroupName),
+			Kind:     "VolumeSnapshot",
+			Name:     source.VolumeSnapshotName,
+		}
+	case source.CodeServerName != "":
+		var sourceCodeServer csv1alpha2.CodeServer
+		if err := r.Get(ctx, client.ObjectKey{Name: source.CodeServerName, Namespace: pvc.Namespace}, &sourceCodeServer); err != nil {
+			return fmt.Errorf("failed to get source CodeServer %q: %w", source.CodeServerName, err)
+		}
+		var sourcePVC corev1.PersistentVolumeClaim
+		if err := r.Get(ctx, client.ObjectKey{Name: sourceCodeServer.HomeClaimName(), Namespace: pvc.Namespace}, &sourcePVC); err != nil {
+			return fmt.Errorf("failed to get PVC of source CodeServer %q: %w", source.CodeServerName, err)
+		}
+
+		if pvc.Spec.StorageClassName == nil {
+			pvc.Spec.StorageClassName = sourcePVC.Spec.StorageClassName
+		}
+
+		if err := validateCloneSize(*pvc, sourcePVC); err != nil {
+			return err
+		}
+
+		method, err := r.resolveCloneMethod(ctx, source.CloneMethod, pvc, &sourcePVC)
+		if err != nil {
+			return err
+		}
+		if method == csv1alpha2.CloneMethodCSIClone {
+			pvc.Spec.DataSourceRef = &corev1.TypedObjectReference{
+				Kind: "PersistentVolumeClaim",
+				Name: sourcePVC.Name,
+			}
+		} else {
+			pvc.Annotations[CopySourceAnnotationKey] = sourcePVC.Name
+		}
+	}
+	return nil
+}
+
+// validateCloneSize returns an error if the requested size of the PVC is less than the size of the source PVC,
+// which can neither be cloned nor hold all the files of the source.
+func validateCloneSize(pvc corev1.PersistentVolumeClaim, sourcePVC corev1.PersistentVolumeClaim) error {
+	sourceSize, ok := sourcePVC.Status.Capacity[corev1.ResourceStorage]
+	if !ok {
+		sourceSize = sourcePVC.Spec.Resources.Requests[corev1.ResourceStorage]
+	}
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if size.Cmp(sourceSize) < 0 {
+		return fmt.Errorf("storage size %s is less than the size %s of the source PVC %q", size.String(), sourceSize.String(), sourcePVC.Name)
+	}
+	return nil
+}
+
+// resolveCloneMethod returns CSIClone for Auto if both PVCs have the same storage class,
+// the provisioner of the storage class is a CSI driver and the storage class is annotated with VolumeCloneAnnotationKey.
+// Otherwise, it returns Copy.
+func (r *CodeServerReconciler) resolveCloneMethod(ctx context.Context, method csv1alpha2.CloneMethod, pvc *corev1.PersistentVolumeClaim, sourcePVC *corev1.PersistentVolumeClaim) (csv1alpha2.CloneMethod, error) {
+	if method != "" && method != csv1alpha2.CloneMethodAuto {
+		return method, nil
+	}
+
+	storageClassName := ptr.Deref(sourcePVC.Spec.StorageClassName, "")
+	if storageClassName == "" || ptr.Deref(pvc.Spec.StorageClassName, "") != storageClassName {
+		return csv1alpha2.CloneMethodCopy, nil
+	}
+
+	var storageClass storagev1.StorageClass
+	err := r.Get(ctx, client.ObjectKey{Name: storageClassName}, &storageClass)
+	if errors.IsNotFound(err) {
+		return csv1alpha2.CloneMethodCopy, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get StorageClass: %w", err)
+	}
+	if storageClass.Annotations[VolumeCloneAnnotationKey] != "true" {
+		return csv1alpha2.CloneMethodCopy, nil
+	}
+
+	var csiDriver storagev1.CSIDriver
+	err = r.Get(ctx, client.ObjectKey{Name: storageClass.Provisioner}, &csiDriver)
+	if errors.IsNotFound(err) {
+		return csv1alpha2.CloneMethodCopy, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get CSIDriver: %w", err)
+	}
+
+	return csv1alpha2.CloneMethodCSIClone, nil
+}
+
+// reconcileCopyJob runs a Job that copies the files of the source PVC into the PVC annotated with CopySourceAnnotationKey.
+// It returns the Ready condition to report while the files are being copied, or nil once the PVC has been populated.
+func (r *CodeServerReconciler) reconcileCopyJob(ctx context.Context, codeServer csv1alpha2.CodeServer) (*metav1.Condition, error) {
+	logger := log.FromContext(ctx)
+
+	if codeServer.Spec.ExistingClaim != "" {
+		return nil, nil
+	}
+
+	var pvc corev1.PersistentVolumeClaim
+	if err := r.Get(ctx, client.ObjectKey{Name: codeServer.Name, Namespace: codeServer.Namespace}, &pvc); err != nil {
+		return nil, fmt.Errorf("failed to get PVC: %w", err)
+	}
+	sourceClaimName, ok := pvc.Annotations[CopySourceAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+
+	jobName := codeServer.Name + "-copy"
+	var job batchv1.Job
+	err := r.Get(ctx, client.ObjectKey{Name: jobName, Namespace: codeServer.Namespace}, &job)
+	if errors.IsNotFound(err) {
+		if err := r.createCopyJob(ctx, codeServer, jobName, sourceClaimName); err != nil {
+			return nil, err
+		}
+		logger.Info("Copy job has been created.", "name", jobName, "namespace", codeServer.Namespace, "source", sourceClaimName)
+		r.recordCreated(&codeServer, "Job", jobName)
+		return copyingCondition(sourceClaimName), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get copy job: %w", err)
+	}
+
+	switch {
+	case jobCondition(job, batchv1.JobFailed) != nil:
+		r.Recorder.Eventf(&codeServer, corev1.EventTypeWarning, "CopyFailed", "Failed to copy the home volume from %q", sourceClaimName)
+		return &metav1.Condition{
+			Reason:  "CopyFailed",
+			Message: fmt.Sprintf("failed to copy the home volume from %q, delete job %q to retry", sourceClaimName, jobName),
+		}, nil
+	case jobCondition(job, batchv1.JobComplete) == nil:
+		return copyingCondition(sourceClaimName), nil
+	}
+
+	patch := client.MergeFrom(pvc.DeepCopy())
+	delete(pvc.Annotations, CopySourceAnnotationKey)
+	if err := r.Patch(ctx, &pvc, patch); err != nil {
+		return nil, fmt.Errorf("failed to patch PVC: %w", err)
+	}
+	if err := r.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+		return nil, fmt.Errorf("failed to delete copy job: %w", err)
+	}
+
+	logger.Info("Home volume has been copied.", "name", codeServer.Name, "namespace", codeServer.Namespace, "source", sourceClaimName)
+	r.Recorder.Eventf(&codeServer, corev1.EventTypeNormal, "Copied", "Copied the home volume from %q", sourceClaimName)
+	return nil, nil
+}
+
+func (r *CodeServerReconciler) createCopyJob(ctx context.Context, codeServer csv1alpha2.CodeServer, name string, sourceClaimName string) error {
+	owner, err := controllerReference(codeServer, r.Scheme)
+	if err != nil {
+		return fmt.Errorf("failed to create controller reference: %w", err)
+	}
+
+	podSecurityContext, containerSecurityContext, err := securityContexts(codeServer.Spec.SecurityContext)
+	if err != nil {
+		return err
+	}
+
+	container := corev1apply.Container().
+		WithName("copy").
+		WithImage(codeServer.Spec.Image).
+		WithCommand("sh", "-c", "cp -a /source/. /target/").
+		WithVolumeMounts(
+			corev1apply.VolumeMount().
+				WithName("source").
+				WithMountPath("/source").
+				WithReadOnly(true),
+			corev1apply.VolumeMount().
+				WithName("target").
+				WithMountPath("/target"),
+		)
+	if containerSecurityContext != nil {
+		container.WithSecurityContext(containerSecurityContext)
+	}
+
+	podSpec := corev1apply.PodSpec().
+		WithRestartPolicy(corev1.RestartPolicyNever).
+		WithContainers(container).
+		WithVolumes(
+			corev1apply.Volume().
+				WithName("source").
+				WithPersistentVolumeClaim(corev1apply.PersistentVolumeClaimVolumeSource().
+					WithClaimName(sourceClaimName).
+					WithReadOnly(true),
+				),
+			corev1apply.Volume().
+				WithName("target").
+				WithPersistentVolumeClaim(corev1apply.PersistentVolumeClaimVolumeSource().
+					WithClaimName(codeServer.Name),
+				),
+		)
+	for _, secret := range codeServer.Spec.ImagePullSecrets {
+		podSpec.WithImagePullSecrets(corev1apply.LocalObjectReference().WithName(secret.Name))
+	}
+	if podSecurityContext != nil {
+		podSpec.WithSecurityContext(podSecurityContext)
+	}
+	if err := applyScheduling(podSpec, codeServer.Spec); err != nil {
+		return err
+	}
+	if codeServer.Spec.Affinity == nil && codeServer.Spec.Source != nil {
+		// The source volume is usually ReadWriteOnce and mounted by the source code server pod.
+		podSpec.WithAffinity(corev1apply.Affinity().
+			WithPodAffinity(corev1apply.PodAffinity().
+				WithPreferredDuringSchedulingIgnoredDuringExecution(corev1apply.WeightedPodAffinityTerm().
+					WithWeight(100).
+					WithPodAffinityTerm(corev1apply.PodAffinityTerm().
+						WithTopologyKey(corev1.LabelHostname).
+						WithLabelSelector(metav1apply.LabelSelector().
+							WithMatchLabels(map[string]string{
+								"app.kubernetes.io/name":     CodeServer,
+								"app.kubernetes.io/instance": codeServer.Spec.Source.CodeServerName,
+							}),
+						),
+					),
+				),
+			),
+		)
+	}
+
+	labels := map[string]string{
+		"app.kubernetes.io/name":       CodeServer,
+		"app.kubernetes.io/instance":   codeServer.Name,
+		"app.kubernetes.io/created-by": CodeServerManager,
+	}
+	job := batchv1apply.Job(name, codeServer.Namespace).
+		WithLabels(labels).
+		WithOwnerReferences(owner).
+		WithSpec(batchv1apply.JobSpec().
+			WithBackoffLimit(3).
+			WithTemplate(corev1apply.PodTemplateSpec().
+				WithLabels(map[string]string{
+					"app.kubernetes.io/name":       CodeServer + "-copy",
+					"app.kubernetes.io/instance":   codeServer.Name,
+					"app.kubernetes.io/created-by": CodeServerManager,
+				}).
+				WithSpec(podSpec),
+			),
+		)
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(job)
+	if err != nil {
+		return fmt.Errorf("failed to convert copy job to unstructured: %w", err)
+	}
+	patch := &unstructured.Unstructured{
+		Object: obj,
+	}
+	if err := r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
+		return fmt.Errorf("failed to apply copy job: %w", err)
+	}
+	return nil
+}
+
+func copyingCondition(sourceClaimName string) *metav1.Condition {
+	return &metav1.Condition{
+		Reason:  "Copying",
+		Message: fmt.Sprintf("copying the home volume from %q", sourceClaimName),
+	}
+}
+
+func jobCondition(job batchv1.Job, conditionType batchv1.JobConditionType) *batchv1.JobCondition {
+	for i := range job.Status.Conditions {
+		if job.Status.Conditions[i].Type == conditionType && job.Status.Conditions[i].Status == corev1.ConditionTrue {
+			return &job.Status.Conditions[i]
+		}
+	}
+	return nil
+}
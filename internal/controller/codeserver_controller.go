@@ -18,32 +18,49 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
 
 	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
 	"github.com/walnuts1018/code-server-operator/internal/initplugins"
 	initpluginsCommon "github.com/walnuts1018/code-server-operator/internal/initplugins/common"
+	"github.com/walnuts1018/code-server-operator/internal/metrics"
+	passwordutil "github.com/walnuts1018/code-server-operator/util/password"
 	"github.com/walnuts1018/code-server-operator/util/random"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
 	appsv1apply "k8s.io/client-go/applyconfigurations/apps/v1"
 	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
 	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
 	networkingv1apply "k8s.io/client-go/applyconfigurations/networking/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 )
 
 const (
@@ -53,10 +70,33 @@ const (
 	MaxKeepSeconds    = 60 * 60 * 24 * 30
 )
 
+const (
+	// OfflineExpansionAnnotationKey is the StorageClass annotation that tells its CSI driver cannot resize the file system online,
+	// so code server pod is restarted to resize the file system of an expanded volume on the next mount.
+	OfflineExpansionAnnotationKey = "cs.walnuts.dev/offline-expansion"
+	// defaultStorageClassAnnotationKey is the StorageClass annotation that marks the default storage class of the cluster.
+	defaultStorageClassAnnotationKey = "storageclass.kubernetes.io/is-default-class"
+)
+
+// ManagedStorageAnnotationsKey is the PVC annotation that records the keys of the annotations set from StorageAnnotations.
+const ManagedStorageAnnotationsKey = "cs.walnuts.dev/managed-storage-annotations"
+
 // CodeServerReconciler reconciles a CodeServer object
 type CodeServerReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// Recorder records the events of the CodeServers.
+	Recorder record.EventRecorder
+
+	// GatewayAvailable reports whether the Gateway API CRDs are installed, to reconcile HTTPRoutes.
+	GatewayAvailable bool
+
+	// OperatorNamespace is the namespace the operator runs in, which the NetworkPolicy allows to scan the ports.
+	OperatorNamespace string
+
+	// portScanner scans the ports of code server pods for PortDiscovery, which is set up with the manager.
+	portScanner *portScanner
 }
 
 //+kubebuilder:rbac:groups=cs.walnuts.dev,resources=codeservers,verbs=get;list;watch;create;update;patch;delete
@@ -70,6 +110,10 @@ type CodeServerReconciler struct {
 //+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=endpoints,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=storageclasses,verbs=get;list;watch
+//+kubebuilder:rbac:groups=storage.k8s.io,resources=csidrivers,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -85,6 +129,10 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	err := r.Client.Get(ctx, req.NamespacedName, &codeServer)
 	if errors.IsNotFound(err) {
 		logger.Info("CodeServer has been deleted. Trying to delete its related resources.")
+		metrics.Forget(req.NamespacedName)
+		if r.portScanner != nil {
+			r.portScanner.Forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, nil
 	}
 	if err != nil {
@@ -92,23 +140,52 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		logger.Error(err, "Failed to get CoderServer.", "name", req.Name, "namespace", req.Namespace)
 		return ctrl.Result{}, err
 	}
+	if err := migrateLegacyStatus(ctx, r.Client, &codeServer); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// Check if the CodeServer instance is marked for deletion
 	if !codeServer.ObjectMeta.DeletionTimestamp.IsZero() {
-		return ctrl.Result{}, nil
+		return r.finalize(ctx, codeServer)
 	}
 
-	if err := r.reconcileSecret(ctx, codeServer); err != nil {
+	if err := r.reconcileFinalizer(ctx, &codeServer); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	if err := r.reconcilePVC(ctx, codeServer); err != nil {
+	if err := r.reconcileOwnerLabels(ctx, &codeServer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	rotationInterval, err := r.reconcileSecret(ctx, &codeServer)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	conflict, err := r.reconcilePVC(ctx, codeServer)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if conflict != nil {
+		return ctrl.Result{}, r.updateNotReadyStatus(ctx, codeServer, *conflict)
+	}
+
+	copying, err := r.reconcileCopyJob(ctx, codeServer)
+	if err != nil {
 		return ctrl.Result{}, err
 	}
+	if copying != nil {
+		return ctrl.Result{}, r.updateNotReadyStatus(ctx, codeServer, *copying)
+	}
 
 	if err := r.reconcileDeployment(ctx, codeServer); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	if err := r.reconcilePortDiscovery(ctx, &codeServer); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	if err := r.reconcileService(ctx, codeServer); err != nil {
 		return ctrl.Result{}, err
 	}
@@ -117,49 +194,177 @@ func (r *CodeServerReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, err
 	}
 
-	return r.updateStatus(ctx, codeServer)
+	if err := r.reconcileHTTPRoute(ctx, codeServer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileNetworkPolicy(ctx, codeServer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileOwnerRBAC(ctx, codeServer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileFileSystemResize(ctx, codeServer); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	result, err := r.updateStatus(ctx, codeServer)
+	if err != nil {
+		return result, err
+	}
+	if rotationInterval > 0 && (result.RequeueAfter == 0 || rotationInterval < result.RequeueAfter) {
+		result.RequeueAfter = rotationInterval
+	}
+	return result, nil
 }
 
-func (r *CodeServerReconciler) reconcileSecret(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+// reconcileSecret generates the password into the secret of the CodeServer, rotating it when it is due,
+// and hashes the password if Hashed is specified. It returns the time to wait before rotating the password.
+func (r *CodeServerReconciler) reconcileSecret(ctx context.Context, codeServer *csv1alpha2.CodeServer) (time.Duration, error) {
 	logger := log.FromContext(ctx)
 
+	var source *corev1.Secret
+	if codeServer.Spec.Password != nil && codeServer.Spec.Password.SecretName != "" {
+		source = &corev1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Name: codeServer.Spec.Password.SecretName, Namespace: codeServer.Namespace}, source); err != nil {
+			return 0, fmt.Errorf("failed to get password secret: %w", err)
+		}
+	}
+
 	secret := &corev1.Secret{}
 	secret.SetName(codeServer.Name)
 	secret.SetNamespace(codeServer.Namespace)
 
+	now := time.Now()
+	rotated := false
 	op, err := ctrl.CreateOrUpdate(ctx, r.Client, secret, func() error {
 		if secret.Data == nil {
 			secret.Data = make(map[string][]byte)
 		}
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
 
-		if _, ok := secret.Data["password"]; !ok {
-			pass, err := random.String(16, random.Alphanumeric)
-			if err != nil {
-				return fmt.Errorf("failed to generate password: %w", err)
+		currentVersion := secret.Annotations[PasswordVersionAnnotation]
+		version := currentVersion
+		var password []byte
+		if source != nil {
+			var ok bool
+			if password, ok = source.Data[passwordKey(*codeServer)]; !ok {
+				return fmt.Errorf("password secret %s does not have key %s", source.Name, passwordKey(*codeServer))
 			}
-			secret.Data["password"] = []byte(pass)
+			delete(secret.Data, PasswordKey)
+			salt, ok := secret.Data[PasswordSaltKey]
+			if !ok {
+				s, err := random.String(32, random.Alphanumeric)
+				if err != nil {
+					return fmt.Errorf("failed to generate password salt: %w", err)
+				}
+				salt = []byte(s)
+				secret.Data[PasswordSaltKey] = salt
+			}
+			// The resource version changes with the other keys and the metadata of the secret as well.
+			version = passwordVersion(password, salt)
+			rotated = currentVersion != "" && version != currentVersion
+		} else {
+			var ok bool
+			password, ok = secret.Data[PasswordKey]
+			if due := ok && passwordRotationDue(*codeServer, *secret, now); !ok || due {
+				pass, err := random.String(16, random.Alphanumeric)
+				if err != nil {
+					return fmt.Errorf("failed to generate password: %w", err)
+				}
+				password = []byte(pass)
+				secret.Data[PasswordKey] = password
+				if due {
+					version = now.UTC().Format(time.RFC3339)
+					rotated = true
+				}
+			}
+		}
+		if version != "" {
+			secret.Annotations[PasswordVersionAnnotation] = version
+		}
+		if rotated {
+			secret.Annotations[PasswordRotatedAtAnnotation] = now.UTC().Format(time.RFC3339)
+		}
+
+		if codeServer.Spec.Password != nil && codeServer.Spec.Password.Hashed {
+			if _, ok := secret.Data[HashedPasswordKey]; !ok || version != currentVersion {
+				hash, err := passwordutil.Hash(string(password))
+				if err != nil {
+					return fmt.Errorf("failed to hash password: %w", err)
+				}
+				secret.Data[HashedPasswordKey] = []byte(hash)
+			}
+		} else {
+			delete(secret.Data, HashedPasswordKey)
 		}
-		return ctrl.SetControllerReference(&codeServer, secret, r.Scheme)
+
+		if authMode(*codeServer) == csv1alpha2.AuthModeOAuth2Proxy {
+			if _, ok := secret.Data[CookieSecretKey]; !ok {
+				cookieSecret, err := random.String(32, random.Alphanumeric)
+				if err != nil {
+					return fmt.Errorf("failed to generate cookie secret: %w", err)
+				}
+				secret.Data[CookieSecretKey] = []byte(cookieSecret)
+			}
+			secret.Data[AuthenticatedEmailsKey] = []byte(strings.Join(codeServer.Spec.Auth.AllowedEmails, "\n"))
+		}
+		return ctrl.SetControllerReference(codeServer, secret, r.Scheme)
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to reconcile secret: %w", err)
+		return 0, fmt.Errorf("failed to reconcile secret: %w", err)
 	}
 
 	if op != controllerutil.OperationResultNone {
 		logger.Info("Secret has been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
 	}
+	if op == controllerutil.OperationResultCreated {
+		r.recordCreated(codeServer, "Secret", secret.Name)
+	}
+	if rotated {
+		logger.Info("Password has been rotated.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+		r.Recorder.Event(codeServer, corev1.EventTypeNormal, "PasswordRotated", "Rotated the password, code server pod is restarted")
+	}
 
-	return nil
+	// The annotation is ignored for a password in an existing secret, which is not rotated by the operator.
+	if err := r.removeRotatePasswordAnnotation(ctx, codeServer); err != nil {
+		return 0, err
+	}
+
+	return nextPasswordRotation(*codeServer, *secret, now), nil
 }
 
-func (r *CodeServerReconciler) reconcilePVC(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+// reconcilePVC creates the PVC of the home volume. It returns the Ready condition to report
+// if a PVC of the same name exists but was not created for the CodeServer, which is never adopted
+// as it may be the existing claim of another CodeServer and would be garbage collected with this one.
+func (r *CodeServerReconciler) reconcilePVC(ctx context.Context, codeServer csv1alpha2.CodeServer) (*metav1.Condition, error) {
 	logger := log.FromContext(ctx)
 
+	if codeServer.Spec.ExistingClaim != "" {
+		return nil, nil
+	}
+
 	pvc := &corev1.PersistentVolumeClaim{}
 	pvc.SetName(codeServer.Name)
 	pvc.SetNamespace(codeServer.Namespace)
 
+	err := r.Get(ctx, client.ObjectKeyFromObject(pvc), pvc)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("failed to get PVC: %w", err)
+	}
+	if err == nil && !isHomeClaimOf(*pvc, codeServer) {
+		r.Recorder.Eventf(&codeServer, corev1.EventTypeWarning, "ClaimConflict", "PVC %s was not created for this CodeServer and is not adopted", pvc.Name)
+		return &metav1.Condition{
+			Reason:  "ClaimConflict",
+			Message: fmt.Sprintf("PVC %q was not created for this CodeServer, delete or rename it, or use another name for the CodeServer", pvc.Name),
+		}, nil
+	}
+
 	op, err := ctrl.CreateOrUpdate(ctx, r.Client, pvc, func() error {
 		if pvc.Labels == nil {
 			pvc.Labels = make(map[string]string)
@@ -171,9 +376,7 @@ func (r *CodeServerReconciler) reconcilePVC(ctx context.Context, codeServer csv1
 		if pvc.Annotations == nil {
 			pvc.Annotations = make(map[string]string)
 		}
-		for k, v := range codeServer.Annotations {
-			pvc.Annotations[k] = v
-		}
+		applyStorageAnnotations(pvc.Annotations, codeServer.Spec.StorageAnnotations)
 
 		if pvc.Spec.AccessModes == nil {
 			pvc.Spec.AccessModes = []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
@@ -185,10 +388,29 @@ func (r *CodeServerReconciler) reconcilePVC(ctx context.Context, codeServer csv1
 
 		storageQuontity, err := resource.ParseQuantity(codeServer.Spec.StorageSize)
 		if err != nil {
+			r.Recorder.Eventf(&codeServer, corev1.EventTypeWarning, "InvalidStorageSize", "Invalid storage size %q: %v", codeServer.Spec.StorageSize, err)
 			return fmt.Errorf("failed to parse storage size: %w", err)
 		}
 
-		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = storageQuontity
+		current, ok := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+		switch {
+		case pvc.CreationTimestamp.IsZero() || !ok:
+			pvc.Spec.Resources.Requests[corev1.ResourceStorage] = storageQuontity
+		case storageQuontity.Cmp(current) < 0:
+			logger.Info("PVC cannot be shrunk.", "name", codeServer.Name, "namespace", codeServer.Namespace, "current", current.String(), "desired", storageQuontity.String())
+			r.Recorder.Eventf(&codeServer, corev1.EventTypeWarning, "InvalidStorageSize", "Storage size %s is less than the current size %s, volume cannot be shrunk", storageQuontity.String(), current.String())
+		case storageQuontity.Cmp(current) > 0:
+			expandable, err := r.isVolumeExpansionAllowed(ctx, pvc)
+			if err != nil {
+				return err
+			}
+			if !expandable {
+				logger.Info("StorageClass does not allow volume expansion.", "name", codeServer.Name, "namespace", codeServer.Namespace, "storageClassName", ptr.Deref(pvc.Spec.StorageClassName, ""))
+				r.Recorder.Eventf(&codeServer, corev1.EventTypeWarning, "InvalidStorageSize", "StorageClass %q does not allow volume expansion to %s", ptr.Deref(pvc.Spec.StorageClassName, ""), storageQuontity.String())
+				break
+			}
+			pvc.Spec.Resources.Requests[corev1.ResourceStorage] = storageQuontity
+		}
 
 		if codeServer.Spec.StorageClassName != "" {
 			pvc.Spec.StorageClassName = &codeServer.Spec.StorageClassName
@@ -198,20 +420,174 @@ func (r *CodeServerReconciler) reconcilePVC(ctx context.Context, codeServer csv1
 			pvc.Spec.VolumeName = codeServer.Spec.VolumeName
 		}
 
+		if pvc.CreationTimestamp.IsZero() && codeServer.Spec.Source != nil {
+			if err := r.populatePVC(ctx, pvc, *codeServer.Spec.Source); err != nil {
+				r.Recorder.Eventf(&codeServer, corev1.EventTypeWarning, "SourceFailed", "Failed to populate the home volume: %v", err)
+				return err
+			}
+		}
+
+		if reclaimsPVC(codeServer) {
+			// The PVC must not be garbage collected before it is retained or archived by the finalizer,
+			// which may happen with foreground cascading deletion if it is owned by the CodeServer.
+			removeOwnerReference(pvc, codeServer.UID)
+			return nil
+		}
 		return ctrl.SetControllerReference(&codeServer, pvc, r.Scheme)
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to reconcile PVC: %w", err)
+		return nil, fmt.Errorf("failed to reconcile PVC: %w", err)
 	}
 
 	if op != controllerutil.OperationResultNone {
 		logger.Info("PVC has been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
 	}
+	if op == controllerutil.OperationResultCreated {
+		r.recordCreated(&codeServer, "PersistentVolumeClaim", pvc.Name)
+	}
+
+	return nil, nil
+}
+
+// isHomeClaimOf tells whether the PVC was created by the operator for the home volume of the CodeServer,
+// or retained from a deleted CodeServer of the same name.
+func isHomeClaimOf(pvc corev1.PersistentVolumeClaim, codeServer csv1alpha2.CodeServer) bool {
+	if pvc.Labels[RetainedFromLabel] == codeServer.Name {
+		return true
+	}
+	return pvc.Labels["app.kubernetes.io/created-by"] == CodeServerManager && pvc.Labels["app.kubernetes.io/instance"] == codeServer.Name
+}
+
+func (r *CodeServerReconciler) isVolumeExpansionAllowed(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	storageClass, err := r.storageClassOf(ctx, pvc)
+	if err != nil || storageClass == nil {
+		return false, err
+	}
+	return ptr.Deref(storageClass.AllowVolumeExpansion, false), nil
+}
+
+// storageClassOf returns the storage class of the PVC, which is the default storage class of the cluster
+// if the PVC does not specify one. It returns nil if the storage class is not found.
+func (r *CodeServerReconciler) storageClassOf(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (*storagev1.StorageClass, error) {
+	if pvc.Spec.StorageClassName == nil {
+		return r.defaultStorageClass(ctx)
+	}
+	// An empty storage class name requests a volume without a storage class.
+	if *pvc.Spec.StorageClassName == "" {
+		return nil, nil
+	}
+
+	var storageClass storagev1.StorageClass
+	err := r.Get(ctx, client.ObjectKey{Name: *pvc.Spec.StorageClassName}, &storageClass)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage class: %w", err)
+	}
+	return &storageClass, nil
+}
+
+// defaultStorageClass returns the default storage class of the cluster, or nil if there is none.
+// As the apiserver does, the newest one is chosen if more than one storage class is marked as default.
+func (r *CodeServerReconciler) defaultStorageClass(ctx context.Context) (*storagev1.StorageClass, error) {
+	var storageClasses storagev1.StorageClassList
+	if err := r.List(ctx, &storageClasses); err != nil {
+		return nil, fmt.Errorf("failed to list storage classes: %w", err)
+	}
 
+	var found *storagev1.StorageClass
+	for i, storageClass := range storageClasses.Items {
+		if storageClass.Annotations[defaultStorageClassAnnotationKey] != "true" {
+			continue
+		}
+		if found == nil || found.CreationTimestamp.Before(&storageClass.CreationTimestamp) {
+			found = &storageClasses.Items[i]
+		}
+	}
+	return found, nil
+}
+
+// reconcileFileSystemResize restarts code server pod when the file system of the expanded volume waits for it,
+// so that it is resized offline on the next mount. As the kubelet resizes the file system online however long it takes
+// if the CSI driver supports it, the pod is restarted only if the storage class is annotated with OfflineExpansionAnnotationKey.
+func (r *CodeServerReconciler) reconcileFileSystemResize(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	var pvc corev1.PersistentVolumeClaim
+	if err := r.Get(ctx, client.ObjectKey{Name: codeServer.HomeClaimName(), Namespace: codeServer.Namespace}, &pvc); err != nil {
+		return fmt.Errorf("failed to get PVC: %w", err)
+	}
+
+	condition := pvcCondition(pvc, corev1.PersistentVolumeClaimFileSystemResizePending)
+	if condition == nil {
+		return nil
+	}
+
+	storageClass, err := r.storageClassOf(ctx, &pvc)
+	if err != nil {
+		return err
+	}
+	if storageClass == nil || storageClass.Annotations[OfflineExpansionAnnotationKey] != "true" {
+		return nil
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(codeServer.Namespace), client.MatchingLabels{
+		"app.kubernetes.io/name":       CodeServer,
+		"app.kubernetes.io/instance":   codeServer.Name,
+		"app.kubernetes.io/created-by": CodeServerManager,
+	}); err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	for _, pod := range pods.Items {
+		if !pod.DeletionTimestamp.IsZero() || !pod.CreationTimestamp.Before(&condition.LastTransitionTime) {
+			continue
+		}
+		r.Recorder.Eventf(&codeServer, corev1.EventTypeNormal, "Restarting", "Restarting pod %s to resize the file system offline", pod.Name)
+		if err := r.Delete(ctx, &pod); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete pod: %w", err)
+		}
+		logger.Info("Pod has been restarted to resize the file system.", "name", codeServer.Name, "namespace", codeServer.Namespace, "pod", pod.Name)
+	}
+
+	return nil
+}
+
+func pvcCondition(pvc corev1.PersistentVolumeClaim, conditionType corev1.PersistentVolumeClaimConditionType) *corev1.PersistentVolumeClaimCondition {
+	for i := range pvc.Status.Conditions {
+		if pvc.Status.Conditions[i].Type == conditionType {
+			return &pvc.Status.Conditions[i]
+		}
+	}
 	return nil
 }
 
+// applyStorageAnnotations sets the storage annotations and removes the ones previously set but no longer specified.
+// Annotations added by users or CSI drivers are kept as they are.
+func applyStorageAnnotations(annotations map[string]string, storageAnnotations map[string]string) {
+	for _, key := range strings.Split(annotations[ManagedStorageAnnotationsKey], ",") {
+		if _, ok := storageAnnotations[key]; !ok {
+			delete(annotations, key)
+		}
+	}
+
+	keys := make([]string, 0, len(storageAnnotations))
+	for k, v := range storageAnnotations {
+		annotations[k] = v
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		delete(annotations, ManagedStorageAnnotationsKey)
+		return
+	}
+	sort.Strings(keys)
+	annotations[ManagedStorageAnnotationsKey] = strings.Join(keys, ",")
+}
+
 func (r *CodeServerReconciler) reconcileDeployment(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
 	logger := log.FromContext(ctx)
 
@@ -226,20 +602,13 @@ func (r *CodeServerReconciler) reconcileDeployment(ctx context.Context, codeServ
 		VolumeName: volumeName,
 	})
 	if err != nil {
+		r.Recorder.Eventf(&codeServer, corev1.EventTypeWarning, "InitPluginFailed", "Failed to create init plugins: %v", err)
 		return fmt.Errorf("failed to create init plugins: %w", err)
 	}
 
 	envs := make([]*corev1apply.EnvVarApplyConfiguration, 0, len(codeServer.Spec.Envs))
 
-	envs = append(envs, corev1apply.EnvVar().
-		WithName("PASSWORD").
-		WithValueFrom(corev1apply.EnvVarSource().
-			WithSecretKeyRef(corev1apply.SecretKeySelector().
-				WithName(codeServer.Name).
-				WithKey("password"),
-			),
-		),
-	)
+	envs = append(envs, passwordEnv(codeServer))
 	for _, env := range codeServer.Spec.Envs {
 		envs = append(envs, corev1apply.EnvVar().
 			WithName(env.Name).
@@ -293,7 +662,17 @@ func (r *CodeServerReconciler) reconcileDeployment(ctx context.Context, codeServ
 		)
 	}
 
-	command := fmt.Sprintf("/usr/bin/entrypoint.sh --bind-addr 0.0.0.0:%d", codeServer.Spec.ContainerPort)
+	command := fmt.Sprintf("/usr/bin/entrypoint.sh --bind-addr %s:%d", bindAddress(codeServer), codeServer.Spec.ContainerPort)
+	proxyDomain, err := proxyDomain(codeServer)
+	if err != nil {
+		return fmt.Errorf("failed to render proxy domain: %w", err)
+	}
+	if proxyDomain != "" {
+		command = fmt.Sprintf("%s --proxy-domain '%s'", command, proxyDomain)
+	}
+	if authMode(codeServer) != csv1alpha2.AuthModePassword {
+		command = fmt.Sprintf("%s --auth none", command)
+	}
 	if codeServer.Spec.InitCommand != "" {
 		command = fmt.Sprintf("%s && %s", codeServer.Spec.InitCommand, command)
 	}
@@ -301,12 +680,148 @@ func (r *CodeServerReconciler) reconcileDeployment(ctx context.Context, codeServ
 	if _, ok := codeServer.Spec.InitPlugins["git"]; ok {
 		command = fmt.Sprintf("%s /home/coder/work", command)
 	}
+
+	podSecurityContext, containerSecurityContext, err := securityContexts(codeServer.Spec.SecurityContext)
+	if err != nil {
+		return fmt.Errorf("failed to create security contexts: %w", err)
+	}
+
+	if containerSecurityContext != nil {
+		for _, initContainer := range initContainers {
+			initContainer.WithSecurityContext(containerSecurityContext)
+		}
+	}
+
+	readinessProbe, err := probeOrDefault(codeServer.Spec.ReadinessProbe, probePort(codeServer), 10, 3)
+	if err != nil {
+		return fmt.Errorf("failed to create readiness probe: %w", err)
+	}
+
+	livenessProbe, err := probeOrDefault(codeServer.Spec.LivenessProbe, probePort(codeServer), 20, 3)
+	if err != nil {
+		return fmt.Errorf("failed to create liveness probe: %w", err)
+	}
+
+	// code server may take a while to start when InitCommand is specified, so allow up to 5 minutes.
+	startupProbe, err := probeOrDefault(codeServer.Spec.StartupProbe, probePort(codeServer), 5, 60)
+	if err != nil {
+		return fmt.Errorf("failed to create startup probe: %w", err)
+	}
+
+	volumes := []*corev1apply.VolumeApplyConfiguration{
+		corev1apply.Volume().
+			WithName(volumeName).
+			WithPersistentVolumeClaim(corev1apply.PersistentVolumeClaimVolumeSource().
+				WithClaimName(codeServer.HomeClaimName()),
+			),
+	}
+	volumeMounts := []*corev1apply.VolumeMountApplyConfiguration{
+		corev1apply.VolumeMount().
+			WithName(volumeName).
+			WithMountPath("/home/coder"),
+	}
+	for _, extraVolume := range codeServer.Spec.ExtraVolumes {
+		v, err := toApplyConfiguration[corev1apply.VolumeApplyConfiguration](corev1.Volume{
+			Name: extraVolume.Name,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: extraVolume.PersistentVolumeClaim,
+				ConfigMap:             extraVolume.ConfigMap,
+				Secret:                extraVolume.Secret,
+				EmptyDir:              extraVolume.EmptyDir,
+				CSI:                   extraVolume.CSI,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to convert extra volume %s: %w", extraVolume.Name, err)
+		}
+		volumes = append(volumes, v)
+
+		mount := corev1apply.VolumeMount().
+			WithName(extraVolume.Name).
+			WithMountPath(extraVolume.MountPath)
+		if extraVolume.ReadOnly {
+			mount.WithReadOnly(true)
+		}
+		volumeMounts = append(volumeMounts, mount)
+	}
+
+	container := corev1apply.Container().
+		WithName(CodeServer).
+		WithImage(codeServer.Spec.Image).
+		WithImagePullPolicy(corev1.PullIfNotPresent).
+		WithPorts(corev1apply.ContainerPort().
+			WithName("http").
+			WithProtocol(corev1.ProtocolTCP).
+			WithContainerPort(codeServer.Spec.ContainerPort),
+		).
+		WithEnv(envs...).
+		WithVolumeMounts(volumeMounts...).
+		WithResources(resourceRequirements).
+		WithReadinessProbe(readinessProbe).
+		WithLivenessProbe(livenessProbe).
+		WithStartupProbe(startupProbe).
+		WithCommand(
+			"/bin/sh",
+			"-c",
+			command,
+		)
+	if containerSecurityContext != nil {
+		container.WithSecurityContext(containerSecurityContext)
+	}
+
+	containers := []*corev1apply.ContainerApplyConfiguration{container}
+	if authMode(codeServer) == csv1alpha2.AuthModeOAuth2Proxy {
+		proxyContainer, proxyVolume := oauth2ProxyContainer(codeServer)
+		if containerSecurityContext != nil {
+			proxyContainer.WithSecurityContext(containerSecurityContext)
+		}
+		containers = append(containers, proxyContainer)
+		if proxyVolume != nil {
+			volumes = append(volumes, proxyVolume)
+		}
+	}
+	for _, sidecar := range codeServer.Spec.Sidecars {
+		c, err := toApplyConfiguration[corev1apply.ContainerApplyConfiguration](sidecar.Container)
+		if err != nil {
+			return fmt.Errorf("failed to convert sidecar %s: %w", sidecar.Name, err)
+		}
+		if sidecar.MountHome {
+			c.WithVolumeMounts(corev1apply.VolumeMount().
+				WithName(volumeName).
+				WithMountPath("/home/coder"),
+			)
+		}
+		if containerSecurityContext != nil && sidecar.SecurityContext == nil {
+			c.WithSecurityContext(containerSecurityContext)
+		}
+
+		if sidecar.RestartPolicy != nil && *sidecar.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			initContainers = append(initContainers, c)
+		} else {
+			containers = append(containers, c)
+		}
+	}
+
+	podSpec := corev1apply.PodSpec().
+		WithImagePullSecrets(imagePullSecrets...).
+		WithInitContainers(initContainers...).
+		WithContainers(containers...).
+		WithVolumes(volumes...)
+	if podSecurityContext != nil {
+		podSpec.WithSecurityContext(podSecurityContext)
+	}
+
+	if err := applyScheduling(podSpec, codeServer.Spec); err != nil {
+		return fmt.Errorf("failed to apply scheduling configuration: %w", err)
+	}
+
 	deployment := appsv1apply.Deployment(codeServer.Name, codeServer.Namespace).
 		WithLabels(map[string]string{
 			"app.kubernetes.io/name":       CodeServer,
 			"app.kubernetes.io/instance":   codeServer.Name,
 			"app.kubernetes.io/created-by": CodeServerManager,
 		}).
+		WithLabels(ownerLabels(codeServer)).
 		WithOwnerReferences(owner).
 		WithSpec(appsv1apply.DeploymentSpec().
 			WithReplicas(1).
@@ -321,47 +836,28 @@ func (r *CodeServerReconciler) reconcileDeployment(ctx context.Context, codeServ
 					"app.kubernetes.io/instance":   codeServer.Name,
 					"app.kubernetes.io/created-by": CodeServerManager,
 				}).
-				WithSpec(corev1apply.PodSpec().
-					WithSecurityContext(corev1apply.PodSecurityContext().
-						WithFSGroup(1000).
-						WithFSGroupChangePolicy(corev1.FSGroupChangeOnRootMismatch).
-						WithRunAsUser(1000).
-						WithRunAsGroup(1000),
-					).
-					WithImagePullSecrets(imagePullSecrets...).
-					WithInitContainers(initContainers...).
-					WithContainers(corev1apply.Container().
-						WithName(CodeServer).
-						WithImage(codeServer.Spec.Image).
-						WithImagePullPolicy(corev1.PullIfNotPresent).
-						WithPorts(corev1apply.ContainerPort().
-							WithName("http").
-							WithProtocol(corev1.ProtocolTCP).
-							WithContainerPort(codeServer.Spec.ContainerPort),
-						).
-						WithEnv(envs...).
-						WithVolumeMounts(corev1apply.VolumeMount().
-							WithName(volumeName).
-							WithMountPath("/home/coder"),
-						).
-						WithResources(resourceRequirements).
-						WithCommand(
-							"/bin/sh",
-							"-c",
-							command,
-						),
-					).
-					WithVolumes(corev1apply.Volume().
-						WithName(volumeName).
-						WithPersistentVolumeClaim(corev1apply.PersistentVolumeClaimVolumeSource().
-							WithClaimName(codeServer.Name),
-						),
-					).
-					WithNodeSelector(codeServer.Spec.NodeSelector),
-				),
+				WithLabels(ownerLabels(codeServer)).
+				WithSpec(podSpec),
 			),
 		)
 
+	// Restart code server pod when the password is changed, since the env is read only on start.
+	var secret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Name: codeServer.Name, Namespace: codeServer.Namespace}, &secret); err != nil {
+		return fmt.Errorf("failed to get secret: %w", err)
+	}
+	if version := secret.Annotations[PasswordVersionAnnotation]; version != "" {
+		deployment.Spec.Template.WithAnnotations(map[string]string{PasswordVersionAnnotation: version})
+	}
+
+	if codeServer.Spec.PodTemplate != nil && len(codeServer.Spec.PodTemplate.Raw) > 0 {
+		template, err := mergePodTemplate(deployment.Spec.Template, codeServer.Spec.PodTemplate.Raw)
+		if err != nil {
+			return fmt.Errorf("failed to merge pod template: %w", err)
+		}
+		deployment.Spec.WithTemplate(template)
+	}
+
 	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(deployment)
 	if err != nil {
 		return fmt.Errorf("failed to convert deployment to unstructured: %w", err)
@@ -386,12 +882,19 @@ func (r *CodeServerReconciler) reconcileDeployment(ctx context.Context, codeServ
 	if equality.Semantic.DeepEqual(deployment, currentApplyConfig) {
 		return nil
 	}
+	rollingOut := currentApplyConfig.Spec == nil || !equality.Semantic.DeepEqual(deployment.Spec.Template, currentApplyConfig.Spec.Template)
 
 	if err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
 		return fmt.Errorf("failed to apply deployment: %w", err)
 	}
 
 	logger.Info("Deployment has been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+	switch {
+	case current.CreationTimestamp.IsZero():
+		r.recordCreated(&codeServer, "Deployment", codeServer.Name)
+	case rollingOut:
+		r.Recorder.Event(&codeServer, corev1.EventTypeNormal, "RollingOut", "Rolling out code server pod with the updated pod template")
+	}
 
 	return nil
 }
@@ -409,10 +912,10 @@ func (r *CodeServerReconciler) reconcileService(ctx context.Context, codeServer
 			WithName("http").
 			WithProtocol(corev1.ProtocolTCP).
 			WithPort(codeServer.Spec.ContainerPort).
-			WithTargetPort(intstr.FromInt32(codeServer.Spec.ContainerPort)),
+			WithTargetPort(intstr.FromInt32(servicePort(codeServer))),
 	}
 
-	for _, port := range codeServer.Spec.PublicProxyPorts {
+	for _, port := range proxyPorts(codeServer) {
 		ports = append(ports, corev1apply.ServicePort().
 			WithName(fmt.Sprintf("http-%d", port)).
 			WithProtocol(corev1.ProtocolTCP).
@@ -427,9 +930,10 @@ func (r *CodeServerReconciler) reconcileService(ctx context.Context, codeServer
 			"app.kubernetes.io/instance":   codeServer.Name,
 			"app.kubernetes.io/created-by": CodeServerManager,
 		}).
+		WithLabels(ownerLabels(codeServer)).
 		WithOwnerReferences(owner).
 		WithSpec(corev1apply.ServiceSpec().
-			WithType(corev1.ServiceTypeClusterIP).
+			WithType(serviceType(codeServer.Spec.Exposure)).
 			WithPorts(ports...,
 			).
 			WithSelector(map[string]string{
@@ -468,6 +972,9 @@ func (r *CodeServerReconciler) reconcileService(ctx context.Context, codeServer
 	}
 
 	logger.Info("Service has been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+	if current.CreationTimestamp.IsZero() {
+		r.recordCreated(&codeServer, "Service", codeServer.Name)
+	}
 
 	return nil
 }
@@ -475,20 +982,44 @@ func (r *CodeServerReconciler) reconcileService(ctx context.Context, codeServer
 func (r *CodeServerReconciler) reconcileIngress(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
 	logger := log.FromContext(ctx)
 
+	host, err := routedHost(codeServer)
+	if err != nil {
+		return fmt.Errorf("failed to render host: %w", err)
+	}
+
+	if host == "" || codeServer.Spec.Routing == csv1alpha2.RoutingHTTPRoute {
+		ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: codeServer.Name, Namespace: codeServer.Namespace}}
+		if err := r.deleteOwned(ctx, codeServer, ingress); err != nil {
+			return fmt.Errorf("failed to delete ingress: %w", err)
+		}
+		return nil
+	}
+
 	owner, err := controllerReference(codeServer, r.Scheme)
 	if err != nil {
 		return fmt.Errorf("failed to create controller reference: %w", err)
 	}
-
-	url, err := url.Parse(codeServer.Spec.Domain)
+	pathPrefix, err := ingressPathPrefix(codeServer)
 	if err != nil {
-		return fmt.Errorf("failed to parse domain: %w", err)
+		return fmt.Errorf("failed to render path prefix: %w", err)
+	}
+
+	annotations := map[string]string{}
+	pathType := networkingv1.PathTypePrefix
+	rootPath := "/"
+	proxyPath := "/proxy/%d"
+	if pathPrefix != "" {
+		// Strip the prefix, but keep /proxy/<port> of the proxy ports as they are served without the prefix.
+		pathType = networkingv1.PathTypeImplementationSpecific
+		rootPath = regexp.QuoteMeta(pathPrefix) + "(?:/|$)(.*)"
+		proxyPath = regexp.QuoteMeta(pathPrefix) + "/(proxy/%d.*)"
+		annotations["nginx.ingress.kubernetes.io/use-regex"] = "true"
+		annotations["nginx.ingress.kubernetes.io/rewrite-target"] = "/$1"
 	}
-	host := fmt.Sprintf("%s.%s", codeServer.Name, url.String())
 
 	paths := []*networkingv1apply.HTTPIngressPathApplyConfiguration{networkingv1apply.HTTPIngressPath().
-		WithPath("/").
-		WithPathType(networkingv1.PathTypePrefix).
+		WithPath(rootPath).
+		WithPathType(pathType).
 		WithBackend(networkingv1apply.IngressBackend().
 			WithService(networkingv1apply.IngressServiceBackend().
 				WithName(codeServer.Name).
@@ -499,15 +1030,20 @@ func (r *CodeServerReconciler) reconcileIngress(ctx context.Context, codeServer
 		),
 	}
 
-	for _, port := range codeServer.Spec.PublicProxyPorts {
+	for _, port := range pathProxyPorts(codeServer) {
+		// Route the proxy ports through oauth2-proxy as well, and code server proxies them.
+		portName := fmt.Sprintf("http-%d", port)
+		if authMode(codeServer) == csv1alpha2.AuthModeOAuth2Proxy {
+			portName = "http"
+		}
 		paths = append(paths, networkingv1apply.HTTPIngressPath().
-			WithPath(fmt.Sprintf("/proxy/%d", port)).
-			WithPathType(networkingv1.PathTypePrefix).
+			WithPath(fmt.Sprintf(proxyPath, port)).
+			WithPathType(pathType).
 			WithBackend(networkingv1apply.IngressBackend().
 				WithService(networkingv1apply.IngressServiceBackend().
 					WithName(codeServer.Name).
 					WithPort(networkingv1apply.ServiceBackendPort().
-						WithName(fmt.Sprintf("http-%d", port)),
+						WithName(portName),
 					),
 				),
 			),
@@ -524,18 +1060,82 @@ func (r *CodeServerReconciler) reconcileIngress(ctx context.Context, codeServer
 			),
 		)
 
+	// Each proxy host is routed to code server, which proxies it to the port with --proxy-domain.
+	hosts := []string{host}
+	for _, proxyHost := range proxyHosts(codeServer, host) {
+		hosts = append(hosts, proxyHost)
+		spec.WithRules(networkingv1apply.IngressRule().
+			WithHost(proxyHost).
+			WithHTTP(networkingv1apply.HTTPIngressRuleValue().
+				WithPaths(networkingv1apply.HTTPIngressPath().
+					WithPath("/").
+					WithPathType(networkingv1.PathTypePrefix).
+					WithBackend(networkingv1apply.IngressBackend().
+						WithService(networkingv1apply.IngressServiceBackend().
+							WithName(codeServer.Name).
+							WithPort(networkingv1apply.ServiceBackendPort().
+								WithName("http"),
+							),
+						),
+					),
+				),
+			),
+		)
+	}
+
 	if codeServer.Spec.IngressClassName != "" {
 		spec = spec.WithIngressClassName(codeServer.Spec.IngressClassName)
 	}
 
+	if tls := codeServer.Spec.TLS; tls != nil {
+		secretName := tls.WildcardSecretName
+		if secretName == "" {
+			secretName, err = renderTemplate(tls.SecretName, codeServer)
+			if err != nil {
+				return fmt.Errorf("failed to render TLS secret name: %w", err)
+			}
+			if secretName == "" {
+				secretName = codeServer.Name + "-tls"
+			}
+			if tls.ClusterIssuer != "" {
+				annotations["cert-manager.io/cluster-issuer"] = tls.ClusterIssuer
+			}
+			if tls.Issuer != "" {
+				annotations["cert-manager.io/issuer"] = tls.Issuer
+			}
+		}
+		spec.WithTLS(networkingv1apply.IngressTLS().
+			WithHosts(hosts...).
+			WithSecretName(secretName),
+		)
+	}
+
+	if authMode(codeServer) == csv1alpha2.AuthModeForwardAuth {
+		authAnnotations, err := forwardAuthAnnotations(codeServer)
+		if err != nil {
+			return err
+		}
+		for key, value := range authAnnotations {
+			annotations[key] = value
+		}
+	}
+
+	for key, value := range codeServer.Spec.IngressAnnotations {
+		annotations[key] = value
+	}
+
 	ingress := networkingv1apply.Ingress(codeServer.Name, codeServer.Namespace).
 		WithLabels(map[string]string{
 			"app.kubernetes.io/name":       CodeServer,
 			"app.kubernetes.io/instance":   codeServer.Name,
 			"app.kubernetes.io/created-by": CodeServerManager,
 		}).
+		WithLabels(ownerLabels(codeServer)).
 		WithOwnerReferences(owner).
 		WithSpec(spec)
+	if len(annotations) > 0 {
+		ingress.WithAnnotations(annotations)
+	}
 
 	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(ingress)
 	if err != nil {
@@ -566,6 +1166,9 @@ func (r *CodeServerReconciler) reconcileIngress(ctx context.Context, codeServer
 	}
 
 	logger.Info("Ingress has been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+	if current.CreationTimestamp.IsZero() {
+		r.recordCreated(&codeServer, "Ingress", codeServer.Name)
+	}
 
 	return nil
 }
@@ -577,37 +1180,468 @@ func (r *CodeServerReconciler) updateStatus(ctx context.Context, codeServer csv1
 		return ctrl.Result{}, err
 	}
 
-	var status csv1alpha2.CodeServerStatus
-	if dep.Status.AvailableReplicas == 0 {
-		status = csv1alpha2.CodeServerNotReady
+	var pvc corev1.PersistentVolumeClaim
+	err = r.Get(ctx, client.ObjectKey{Name: codeServer.HomeClaimName(), Namespace: codeServer.Namespace}, &pvc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(codeServer.Namespace), client.MatchingLabels{
+		"app.kubernetes.io/name":       CodeServer,
+		"app.kubernetes.io/instance":   codeServer.Name,
+		"app.kubernetes.io/created-by": CodeServerManager,
+	}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to list pods: %w", err)
+	}
+	podHealthy := observePods(codeServer, pods.Items, pvc)
+
+	status := codeServer.Status.DeepCopy()
+	phase, ready := observeReady(codeServer, dep.Status.ReadyReplicas, podHealthy)
+	status.Phase = phase
+	meta.SetStatusCondition(&status.Conditions, ready)
+	meta.SetStatusCondition(&status.Conditions, podHealthy)
+
+	storageStatus, storageCondition, err := observeStorage(codeServer, pvc)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	status.Storage = storageStatus
+	if storageCondition != nil {
+		meta.SetStatusCondition(&status.Conditions, *storageCondition)
+	}
+
+	status.PasswordRotatedAt, err = r.observePasswordRotation(ctx, codeServer)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status.URL, err = r.publicURL(ctx, codeServer)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	routeCondition, err := r.observeHTTPRoute(ctx, codeServer)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if routeCondition != nil {
+		meta.SetStatusCondition(&status.Conditions, *routeCondition)
 	} else {
-		status = csv1alpha2.CodeServerReady
+		meta.RemoveStatusCondition(&status.Conditions, csv1alpha2.ConditionTypeRouteAccepted)
 	}
 
-	if codeServer.Status != status {
-		codeServer.Status = status
+	if err := r.recordInitPluginFailures(codeServer, pods.Items); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if !equality.Semantic.DeepEqual(codeServer.Status, *status) {
+		next := *status
+		current := codeServer
+		codeServer.Status = next
 		err = r.Status().Update(ctx, &codeServer)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
+		r.recordTransition(current, next, time.Now())
 	}
 
-	if codeServer.Status == csv1alpha2.CodeServerNotReady {
-		return ctrl.Result{Requeue: true}, nil
+	if codeServer.Status.Phase == csv1alpha2.CodeServerNotReady {
+		var elapsed time.Duration
+		if ready := meta.FindStatusCondition(codeServer.Status.Conditions, csv1alpha2.ConditionTypeReady); ready != nil {
+			elapsed = time.Since(ready.LastTransitionTime.Time)
+		}
+		return ctrl.Result{RequeueAfter: notReadyRequeueAfter(elapsed)}, nil
 	}
 	return ctrl.Result{}, nil
 }
 
+// observeReady returns the phase and the Ready condition of code server from the number of the ready pods of the Deployment.
+// The message of the Ready condition tells the failure of the pods while they are not ready.
+func observeReady(codeServer csv1alpha2.CodeServer, readyReplicas int32, podHealthy metav1.Condition) (csv1alpha2.CodeServerPhase, metav1.Condition) {
+	if readyReplicas > 0 {
+		return csv1alpha2.CodeServerReady, metav1.Condition{
+			Type:               csv1alpha2.ConditionTypeReady,
+			Status:             metav1.ConditionTrue,
+			Reason:             "PodReady",
+			Message:            "code server pod is ready",
+			ObservedGeneration: codeServer.Generation,
+		}
+	}
+
+	message := "code server pod is not ready"
+	if podHealthy.Status == metav1.ConditionFalse {
+		message += ": " + podHealthy.Message
+	}
+	return csv1alpha2.CodeServerNotReady, metav1.Condition{
+		Type:               csv1alpha2.ConditionTypeReady,
+		Status:             metav1.ConditionFalse,
+		Reason:             notReadyReason(codeServer),
+		Message:            message,
+		ObservedGeneration: codeServer.Generation,
+	}
+}
+
+// updateNotReadyStatus reports that code server pod is not ready with the reason and message of the condition,
+// while the Deployment cannot be reconciled yet.
+func (r *CodeServerReconciler) updateNotReadyStatus(ctx context.Context, codeServer csv1alpha2.CodeServer, condition metav1.Condition) error {
+	status := codeServer.Status.DeepCopy()
+	status.Phase = csv1alpha2.CodeServerNotReady
+	condition.Type = csv1alpha2.ConditionTypeReady
+	condition.Status = metav1.ConditionFalse
+	condition.ObservedGeneration = codeServer.Generation
+	meta.SetStatusCondition(&status.Conditions, condition)
+
+	if equality.Semantic.DeepEqual(codeServer.Status, *status) {
+		return nil
+	}
+	codeServer.Status = *status
+	return r.Status().Update(ctx, &codeServer)
+}
+
+// observeStorage returns the observed state of the PVC and the StorageResized condition.
+// The condition is nil while the PVC is not bound.
+func observeStorage(codeServer csv1alpha2.CodeServer, pvc corev1.PersistentVolumeClaim) (*csv1alpha2.CodeServerStorageStatus, *metav1.Condition, error) {
+	status := &csv1alpha2.CodeServerStorageStatus{
+		FileSystemResizePending: pvcCondition(pvc, corev1.PersistentVolumeClaimFileSystemResizePending) != nil,
+	}
+
+	capacity, ok := pvc.Status.Capacity[corev1.ResourceStorage]
+	if !ok {
+		return status, nil, nil
+	}
+	status.Capacity = &capacity
+
+	// StorageSize is not applied to an existing claim.
+	if codeServer.Spec.ExistingClaim != "" {
+		return status, nil, nil
+	}
+
+	desired, err := resource.ParseQuantity(codeServer.Spec.StorageSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse storage size: %w", err)
+	}
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+
+	condition := &metav1.Condition{
+		Type:               csv1alpha2.ConditionTypeStorageResized,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: codeServer.Generation,
+	}
+	switch {
+	case desired.Cmp(requested) < 0:
+		condition.Reason = "ShrinkNotAllowed"
+		condition.Message = fmt.Sprintf("storage size cannot be decreased from %s to %s", requested.String(), desired.String())
+	case desired.Cmp(requested) > 0:
+		condition.Reason = "ExpansionNotAllowed"
+		condition.Message = fmt.Sprintf("storage class %q does not allow volume expansion", ptr.Deref(pvc.Spec.StorageClassName, ""))
+	case status.FileSystemResizePending:
+		condition.Reason = "FileSystemResizePending"
+		condition.Message = "waiting for the file system to be resized on the node"
+	case capacity.Cmp(requested) < 0:
+		condition.Reason = "Resizing"
+		condition.Message = fmt.Sprintf("volume is being resized from %s to %s", capacity.String(), requested.String())
+	default:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "Resized"
+		condition.Message = "capacity satisfies the storage size"
+	}
+
+	return status, condition, nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *CodeServerReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	r.portScanner = newPortScanner()
+	if err := mgr.Add(r.portScanner); err != nil {
+		return fmt.Errorf("failed to add port scanner: %w", err)
+	}
+
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&csv1alpha2.CodeServer{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Service{}).
-		Owns(&corev1.PersistentVolumeClaim{}).
+		// Watch the PVCs by their labels, since a retained or archived PVC is not owned by the CodeServer.
+		Watches(&corev1.PersistentVolumeClaim{}, handler.EnqueueRequestsFromMapFunc(codeServerForObject)).
 		Owns(&corev1.Secret{}).
 		Owns(&networkingv1.Ingress{}).
-		Complete(r)
+		Owns(&networkingv1.NetworkPolicy{}).
+		Owns(&rbacv1.Role{}).
+		Owns(&rbacv1.RoleBinding{}).
+		Owns(&batchv1.Job{}).
+		// Watch the pods, which are owned by the ReplicaSets, to report their failures.
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(codeServerForObject)).
+		// Watch the existing secrets of the passwords to restart code server pod when they are changed.
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.codeServersForSecret)).
+		// Enqueue the CodeServers whose ports have been found changed by the port scanner.
+		WatchesRawSource(source.Channel(r.portScanner.events, &handler.EnqueueRequestForObject{}))
+	if r.GatewayAvailable {
+		// Watch the status of HTTPRoutes to report whether they are accepted.
+		builder = builder.Owns(&gatewayv1.HTTPRoute{})
+	}
+	return builder.Complete(r)
+}
+
+// probeOrDefault returns the probe, or an HTTP GET of /healthz on port when it is not specified.
+func probeOrDefault(probe *corev1.Probe, port intstr.IntOrString, periodSeconds int32, failureThreshold int32) (*corev1apply.ProbeApplyConfiguration, error) {
+	if probe != nil {
+		return toApplyConfiguration[corev1apply.ProbeApplyConfiguration](probe)
+	}
+
+	return corev1apply.Probe().
+		WithHTTPGet(corev1apply.HTTPGetAction().
+			WithPath("/healthz").
+			WithPort(port),
+		).
+		WithPeriodSeconds(periodSeconds).
+		WithFailureThreshold(failureThreshold), nil
+}
+
+// securityContexts returns the pod and container security contexts for the profile of the CodeServer.
+func securityContexts(sc *csv1alpha2.CodeServerSecurityContext) (*corev1apply.PodSecurityContextApplyConfiguration, *corev1apply.SecurityContextApplyConfiguration, error) {
+	if sc == nil {
+		sc = &csv1alpha2.CodeServerSecurityContext{}
+	}
+
+	if sc.Profile == csv1alpha2.SecurityContextProfileCustom {
+		var pod *corev1apply.PodSecurityContextApplyConfiguration
+		if sc.Pod != nil {
+			p, err := toApplyConfiguration[corev1apply.PodSecurityContextApplyConfiguration](sc.Pod)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to convert pod security context: %w", err)
+			}
+			pod = p
+		}
+
+		var container *corev1apply.SecurityContextApplyConfiguration
+		if sc.Container != nil {
+			c, err := toApplyConfiguration[corev1apply.SecurityContextApplyConfiguration](sc.Container)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to convert container security context: %w", err)
+			}
+			container = c
+		}
+		return pod, container, nil
+	}
+
+	pod := corev1apply.PodSecurityContext().
+		WithFSGroup(ptr.Deref(sc.FSGroup, 1000)).
+		WithFSGroupChangePolicy(corev1.FSGroupChangeOnRootMismatch).
+		WithRunAsUser(ptr.Deref(sc.RunAsUser, 1000)).
+		WithRunAsGroup(ptr.Deref(sc.RunAsGroup, 1000))
+
+	if sc.Profile != csv1alpha2.SecurityContextProfileRestricted {
+		return pod, nil, nil
+	}
+
+	pod.WithRunAsNonRoot(true).
+		WithSeccompProfile(corev1apply.SeccompProfile().
+			WithType(corev1.SeccompProfileTypeRuntimeDefault),
+		)
+
+	container := corev1apply.SecurityContext().
+		WithAllowPrivilegeEscalation(false).
+		WithRunAsNonRoot(true).
+		WithCapabilities(corev1apply.Capabilities().
+			WithDrop("ALL"),
+		).
+		WithSeccompProfile(corev1apply.SeccompProfile().
+			WithType(corev1.SeccompProfileTypeRuntimeDefault),
+		)
+
+	return pod, container, nil
+}
+
+// applyScheduling sets the scheduling related fields of the CodeServer spec on the pod spec.
+func applyScheduling(podSpec *corev1apply.PodSpecApplyConfiguration, spec csv1alpha2.CodeServerSpec) error {
+	podSpec.WithNodeSelector(spec.NodeSelector)
+
+	for _, toleration := range spec.Tolerations {
+		t, err := toApplyConfiguration[corev1apply.TolerationApplyConfiguration](toleration)
+		if err != nil {
+			return fmt.Errorf("failed to convert toleration: %w", err)
+		}
+		podSpec.WithTolerations(t)
+	}
+
+	if spec.Affinity != nil {
+		affinity, err := toApplyConfiguration[corev1apply.AffinityApplyConfiguration](spec.Affinity)
+		if err != nil {
+			return fmt.Errorf("failed to convert affinity: %w", err)
+		}
+		podSpec.WithAffinity(affinity)
+	}
+
+	for _, constraint := range spec.TopologySpreadConstraints {
+		c, err := toApplyConfiguration[corev1apply.TopologySpreadConstraintApplyConfiguration](constraint)
+		if err != nil {
+			return fmt.Errorf("failed to convert topology spread constraint: %w", err)
+		}
+		podSpec.WithTopologySpreadConstraints(c)
+	}
+
+	if spec.PriorityClassName != "" {
+		podSpec.WithPriorityClassName(spec.PriorityClassName)
+	}
+
+	if spec.RuntimeClassName != nil {
+		podSpec.WithRuntimeClassName(*spec.RuntimeClassName)
+	}
+
+	if spec.SchedulerName != "" {
+		podSpec.WithSchedulerName(spec.SchedulerName)
+	}
+
+	return nil
+}
+
+// mergePodTemplate merges the overlay over the pod template with strategic merge patch semantics.
+func mergePodTemplate(template *corev1apply.PodTemplateSpecApplyConfiguration, overlay []byte) (*corev1apply.PodTemplateSpecApplyConfiguration, error) {
+	original, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := strategicpatch.StrategicMergePatch(original, overlay, corev1.PodTemplateSpec{})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &corev1apply.PodTemplateSpecApplyConfiguration{}
+	if err := json.Unmarshal(merged, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// routedHost returns the host routed to code server by the Ingress or HTTPRoute,
+// or empty if code server is not exposed with them.
+func routedHost(codeServer csv1alpha2.CodeServer) (string, error) {
+	if codeServer.Spec.Exposure != csv1alpha2.ExposureIngress {
+		return "", nil
+	}
+	return ingressHost(codeServer)
+}
+
+// ingressHost returns the host of code server rendered from HostTemplate.
+// The host is empty if the default template is used without Domain.
+func ingressHost(codeServer csv1alpha2.CodeServer) (string, error) {
+	hostTemplate := codeServer.Spec.HostTemplate
+	switch {
+	case hostTemplate != "":
+	case codeServer.Spec.Domain == "":
+		return "", nil
+	case codeServer.Spec.PathPrefixTemplate != "":
+		hostTemplate = "{{ .Domain }}"
+	default:
+		hostTemplate = "{{ .Name }}.{{ .Domain }}"
+	}
+	return renderTemplate(hostTemplate, codeServer)
+}
+
+// pathProxyPorts returns the proxy ports exposed at /proxy/<port> of the host, which is none if ProxyMode is Subdomain.
+func pathProxyPorts(codeServer csv1alpha2.CodeServer) []int32 {
+	if codeServer.Spec.ProxyMode == csv1alpha2.ProxyModeSubdomain {
+		return nil
+	}
+	return proxyPorts(codeServer)
+}
+
+// proxyHosts returns the hosts of the proxy ports if ProxyMode is Subdomain.
+func proxyHosts(codeServer csv1alpha2.CodeServer, host string) []string {
+	if codeServer.Spec.ProxyMode != csv1alpha2.ProxyModeSubdomain || host == "" {
+		return nil
+	}
+	ports := proxyPorts(codeServer)
+	hosts := make([]string, 0, len(ports))
+	for _, port := range ports {
+		hosts = append(hosts, fmt.Sprintf("%d-%s", port, host))
+	}
+	return hosts
+}
+
+// proxyDomain returns the --proxy-domain flag of code server matching proxyHosts, or empty if ProxyMode is not Subdomain.
+func proxyDomain(codeServer csv1alpha2.CodeServer) (string, error) {
+	if codeServer.Spec.ProxyMode != csv1alpha2.ProxyModeSubdomain {
+		return "", nil
+	}
+	host, err := routedHost(codeServer)
+	if err != nil || host == "" {
+		return "", err
+	}
+	return "{{port}}-" + host, nil
+}
+
+// ingressPathPrefix returns the path prefix of code server rendered from PathPrefixTemplate without the trailing slash.
+func ingressPathPrefix(codeServer csv1alpha2.CodeServer) (string, error) {
+	if codeServer.Spec.PathPrefixTemplate == "" {
+		return "", nil
+	}
+	prefix, err := renderTemplate(codeServer.Spec.PathPrefixTemplate, codeServer)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(prefix, "/"), nil
+}
+
+// templateData is the data of the templates in CodeServerSpec.
+type templateData struct {
+	Name      string
+	Namespace string
+	Labels    map[string]string
+	Domain    string
+}
+
+// renderTemplate executes the Go template text with the name, namespace, labels and domain of the CodeServer.
+func renderTemplate(text string, codeServer csv1alpha2.CodeServer) (string, error) {
+	tmpl, err := template.New("").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, templateData{
+		Name:      codeServer.Name,
+		Namespace: codeServer.Namespace,
+		Labels:    codeServer.Labels,
+		Domain:    codeServer.Spec.Domain,
+	}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// toApplyConfiguration converts a typed API object into the corresponding apply configuration.
+// Both share the same JSON representation, so the conversion is a JSON round trip.
+func toApplyConfiguration[T any](in any) (*T, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(T)
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// recordCreated records an event that the resource of kind for code server has been created.
+func (r *CodeServerReconciler) recordCreated(codeServer *csv1alpha2.CodeServer, kind string, name string) {
+	r.Recorder.Eventf(codeServer, corev1.EventTypeNormal, "Created", "Created %s %s", kind, name)
+}
+
+// deleteOwned deletes the stale object if it is controlled by the CodeServer, leaving an object of the same name
+// created by someone else alone. The object is looked up in the cache first, so that nothing is requested
+// to the apiserver if there is nothing to delete.
+func (r *CodeServerReconciler) deleteOwned(ctx context.Context, codeServer csv1alpha2.CodeServer, obj client.Object) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(obj), obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, &codeServer) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, obj, client.Preconditions{UID: ptr.To(obj.GetUID())}))
 }
 
 func controllerReference(codeServer csv1alpha2.CodeServer, scheme *runtime.Scheme) (*metav1apply.OwnerReferenceApplyConfiguration, error) {
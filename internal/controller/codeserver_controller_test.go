@@ -18,12 +18,33 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
@@ -69,8 +90,9 @@ var _ = Describe("CodeServer Controller", func() {
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &CodeServerReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(100),
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
@@ -81,4 +103,1228 @@ var _ = Describe("CodeServer Controller", func() {
 			// Example: If you expect a certain status condition after reconciliation, verify it here.
 		})
 	})
+
+	Context("When scheduling code server", func() {
+		It("should set the scheduling fields on the pod spec", func() {
+			spec := csv1alpha2.CodeServerSpec{
+				NodeSelector: map[string]string{"kubernetes.io/arch": "amd64"},
+				Affinity: &corev1.Affinity{
+					NodeAffinity: &corev1.NodeAffinity{
+						RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+							NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+								MatchExpressions: []corev1.NodeSelectorRequirement{{
+									Key:      "node-role.kubernetes.io/workspace",
+									Operator: corev1.NodeSelectorOpExists,
+								}},
+							}},
+						},
+					},
+				},
+				Tolerations: []corev1.Toleration{{
+					Key:      "workspace",
+					Operator: corev1.TolerationOpEqual,
+					Value:    "true",
+					Effect:   corev1.TaintEffectNoSchedule,
+				}},
+				PriorityClassName: "workspace",
+				TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{
+					MaxSkew:           1,
+					TopologyKey:       corev1.LabelHostname,
+					WhenUnsatisfiable: corev1.ScheduleAnyway,
+				}},
+				RuntimeClassName: ptr.To("gvisor"),
+				SchedulerName:    "workspace-scheduler",
+			}
+
+			podSpec := corev1apply.PodSpec()
+			Expect(applyScheduling(podSpec, spec)).To(Succeed())
+			Expect(podSpec.NodeSelector).To(Equal(map[string]string{"kubernetes.io/arch": "amd64"}))
+			terms := podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			Expect(terms).To(HaveLen(1))
+			Expect(*terms[0].MatchExpressions[0].Key).To(Equal("node-role.kubernetes.io/workspace"))
+			Expect(podSpec.Tolerations).To(HaveLen(1))
+			Expect(*podSpec.Tolerations[0].Key).To(Equal("workspace"))
+			Expect(*podSpec.Tolerations[0].Effect).To(Equal(corev1.TaintEffectNoSchedule))
+			Expect(*podSpec.PriorityClassName).To(Equal("workspace"))
+			Expect(podSpec.TopologySpreadConstraints).To(HaveLen(1))
+			Expect(*podSpec.TopologySpreadConstraints[0].TopologyKey).To(Equal(corev1.LabelHostname))
+			Expect(*podSpec.TopologySpreadConstraints[0].WhenUnsatisfiable).To(Equal(corev1.ScheduleAnyway))
+			Expect(*podSpec.RuntimeClassName).To(Equal("gvisor"))
+			Expect(*podSpec.SchedulerName).To(Equal("workspace-scheduler"))
+		})
+
+		It("should leave the scheduling fields unset by default", func() {
+			podSpec := corev1apply.PodSpec()
+			Expect(applyScheduling(podSpec, csv1alpha2.CodeServerSpec{})).To(Succeed())
+			Expect(podSpec).To(Equal(corev1apply.PodSpec()))
+		})
+	})
+
+	Context("When probing code server", func() {
+		It("should probe /healthz on the container port by default", func() {
+			probe, err := probeOrDefault(nil, intstr.FromString("http"), 5, 60)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*probe.HTTPGet.Path).To(Equal("/healthz"))
+			Expect(*probe.HTTPGet.Port).To(Equal(intstr.FromString("http")))
+			Expect(*probe.PeriodSeconds).To(BeEquivalentTo(5))
+			Expect(*probe.FailureThreshold).To(BeEquivalentTo(60))
+		})
+
+		It("should use the specified probe as it is", func() {
+			probe, err := probeOrDefault(&corev1.Probe{
+				ProbeHandler: corev1.ProbeHandler{
+					TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(19200)},
+				},
+				PeriodSeconds: 30,
+			}, intstr.FromString("http"), 5, 60)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(probe.HTTPGet).To(BeNil())
+			Expect(*probe.TCPSocket.Port).To(Equal(intstr.FromInt32(19200)))
+			Expect(*probe.PeriodSeconds).To(BeEquivalentTo(30))
+			Expect(probe.FailureThreshold).To(BeNil())
+		})
+	})
+
+	Context("When observing the readiness", func() {
+		healthy := metav1.Condition{Type: csv1alpha2.ConditionTypePodHealthy, Status: metav1.ConditionTrue, Reason: "Healthy"}
+
+		It("should be ready when a pod of the Deployment is ready", func() {
+			codeServer := csv1alpha2.CodeServer{ObjectMeta: metav1.ObjectMeta{Generation: 2}}
+			phase, ready := observeReady(codeServer, 1, healthy)
+			Expect(phase).To(Equal(csv1alpha2.CodeServerReady))
+			Expect(ready.Type).To(Equal(csv1alpha2.ConditionTypeReady))
+			Expect(ready.Status).To(Equal(metav1.ConditionTrue))
+			Expect(ready.Reason).To(Equal("PodReady"))
+			Expect(ready.ObservedGeneration).To(BeEquivalentTo(2))
+		})
+
+		It("should tell the failure of the pod while it is not ready", func() {
+			phase, ready := observeReady(csv1alpha2.CodeServer{}, 0, healthy)
+			Expect(phase).To(Equal(csv1alpha2.CodeServerNotReady))
+			Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+			Expect(ready.Reason).To(Equal("Creating"))
+			Expect(ready.Message).To(Equal("code server pod is not ready"))
+
+			failed := metav1.Condition{Type: csv1alpha2.ConditionTypePodHealthy, Status: metav1.ConditionFalse, Reason: "CrashLoopBackOff", Message: `container "code-server" is crashing`}
+			_, ready = observeReady(csv1alpha2.CodeServer{}, 0, failed)
+			Expect(ready.Message).To(Equal(`code server pod is not ready: container "code-server" is crashing`))
+		})
+	})
+
+	Context("When migrating the legacy status", func() {
+		It("should decode the legacy status into the phase", func() {
+			var codeServer csv1alpha2.CodeServer
+			Expect(json.Unmarshal([]byte(`{"status":"Ready"}`), &codeServer)).To(Succeed())
+			Expect(codeServer.Status).To(Equal(csv1alpha2.CodeServerStatus{Phase: csv1alpha2.CodeServerReady}))
+		})
+
+		It("should replace only the legacy status with an object", func() {
+			legacy := &unstructured.Unstructured{Object: map[string]any{"status": "Suspended"}}
+			patch, ok, err := legacyStatusPatch(legacy)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(string(patch)).To(Equal(`{"status":{"phase":"Suspended"}}`))
+
+			current := &unstructured.Unstructured{Object: map[string]any{"status": map[string]any{"phase": "Ready"}}}
+			_, ok, err = legacyStatusPatch(current)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("When applying storage annotations", func() {
+		It("should prune only the annotations previously set from storageAnnotations", func() {
+			annotations := map[string]string{
+				"example.com/user": "kept",
+			}
+
+			applyStorageAnnotations(annotations, map[string]string{
+				"example.com/a": "1",
+				"example.com/b": "2",
+			})
+			Expect(annotations).To(Equal(map[string]string{
+				"example.com/user":           "kept",
+				"example.com/a":              "1",
+				"example.com/b":              "2",
+				ManagedStorageAnnotationsKey: "example.com/a,example.com/b",
+			}))
+
+			applyStorageAnnotations(annotations, map[string]string{
+				"example.com/b": "3",
+			})
+			Expect(annotations).To(Equal(map[string]string{
+				"example.com/user":           "kept",
+				"example.com/b":              "3",
+				ManagedStorageAnnotationsKey: "example.com/b",
+			}))
+
+			applyStorageAnnotations(annotations, nil)
+			Expect(annotations).To(Equal(map[string]string{
+				"example.com/user": "kept",
+			}))
+		})
+	})
+
+	Context("When observing the storage", func() {
+		newPVC := func(requested, capacity string) corev1.PersistentVolumeClaim {
+			return corev1.PersistentVolumeClaim{
+				Spec: corev1.PersistentVolumeClaimSpec{
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(requested)},
+					},
+				},
+				Status: corev1.PersistentVolumeClaimStatus{
+					Capacity: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)},
+				},
+			}
+		}
+
+		DescribeTable("should report the StorageResized condition",
+			func(storageSize string, pvc corev1.PersistentVolumeClaim, status metav1.ConditionStatus, reason string) {
+				codeServer := csv1alpha2.CodeServer{Spec: csv1alpha2.CodeServerSpec{StorageSize: storageSize}}
+
+				storage, condition, err := observeStorage(codeServer, pvc)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(storage.Capacity.String()).To(Equal(pvc.Status.Capacity.Storage().String()))
+				Expect(condition.Status).To(Equal(status))
+				Expect(condition.Reason).To(Equal(reason))
+			},
+			Entry("resized", "2Gi", newPVC("2Gi", "2Gi"), metav1.ConditionTrue, "Resized"),
+			Entry("shrink", "1Gi", newPVC("2Gi", "2Gi"), metav1.ConditionFalse, "ShrinkNotAllowed"),
+			Entry("expansion not allowed", "3Gi", newPVC("2Gi", "2Gi"), metav1.ConditionFalse, "ExpansionNotAllowed"),
+			Entry("resizing", "3Gi", newPVC("3Gi", "2Gi"), metav1.ConditionFalse, "Resizing"),
+		)
+	})
+
+	Context("When resizing the file system", func() {
+		ctx := context.Background()
+
+		storageClass := func(name string, annotations map[string]string, age time.Duration) *storagev1.StorageClass {
+			return &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:              name,
+					Annotations:       annotations,
+					CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+				},
+				Provisioner:          "csi.example.com",
+				AllowVolumeExpansion: ptr.To(true),
+			}
+		}
+		newReconciler := func(objects ...client.Object) *CodeServerReconciler {
+			return &CodeServerReconciler{
+				Client:   fake.NewClientBuilder().WithObjects(objects...).Build(),
+				Recorder: record.NewFakeRecorder(10),
+			}
+		}
+
+		It("should resolve the default storage class for a PVC without one", func() {
+			controllerReconciler := newReconciler(
+				storageClass("standard", nil, 0),
+				storageClass("old-default", map[string]string{defaultStorageClassAnnotationKey: "true"}, time.Hour),
+				storageClass("default", map[string]string{defaultStorageClassAnnotationKey: "true"}, time.Minute),
+			)
+
+			expandable, err := controllerReconciler.isVolumeExpansionAllowed(ctx, &corev1.PersistentVolumeClaim{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expandable).To(BeTrue())
+
+			resolved, err := controllerReconciler.storageClassOf(ctx, &corev1.PersistentVolumeClaim{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Name).To(Equal("default"))
+
+			resolved, err = controllerReconciler.storageClassOf(ctx, &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: ptr.To("")}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved).To(BeNil())
+		})
+
+		DescribeTable("should restart the pod only if the storage class cannot resize online",
+			func(annotations map[string]string, restarted bool) {
+				resizedAt := metav1.NewTime(time.Now().Add(-time.Hour))
+				pvc := &corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+					Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: ptr.To("csi")},
+					Status: corev1.PersistentVolumeClaimStatus{Conditions: []corev1.PersistentVolumeClaimCondition{{
+						Type:               corev1.PersistentVolumeClaimFileSystemResizePending,
+						Status:             corev1.ConditionTrue,
+						LastTransitionTime: resizedAt,
+					}}},
+				}
+				pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+					Name:              "alice-0",
+					Namespace:         "default",
+					CreationTimestamp: metav1.NewTime(resizedAt.Add(-time.Hour)),
+					Labels: map[string]string{
+						"app.kubernetes.io/name":       CodeServer,
+						"app.kubernetes.io/instance":   "alice",
+						"app.kubernetes.io/created-by": CodeServerManager,
+					},
+				}}
+				controllerReconciler := newReconciler(storageClass("csi", annotations, 0), pvc, pod)
+				codeServer := csv1alpha2.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"}}
+
+				Expect(controllerReconciler.reconcileFileSystemResize(ctx, codeServer)).To(Succeed())
+
+				err := controllerReconciler.Get(ctx, client.ObjectKeyFromObject(pod), &corev1.Pod{})
+				if !restarted {
+					Expect(err).NotTo(HaveOccurred())
+					Expect(controllerReconciler.Recorder.(*record.FakeRecorder).Events).To(BeEmpty())
+					return
+				}
+				Expect(errors.IsNotFound(err)).To(BeTrue())
+				Expect(controllerReconciler.Recorder.(*record.FakeRecorder).Events).To(Receive(Equal("Normal Restarting Restarting pod alice-0 to resize the file system offline")))
+			},
+			Entry("online", nil, false),
+			Entry("offline", map[string]string{OfflineExpansionAnnotationKey: "true"}, true),
+		)
+	})
+
+	Context("When resolving the clone method", func() {
+		ctx := context.Background()
+
+		objects := []client.Object{
+			&storagev1.StorageClass{
+				ObjectMeta:  metav1.ObjectMeta{Name: "csi", Annotations: map[string]string{VolumeCloneAnnotationKey: "true"}},
+				Provisioner: "csi.example.com",
+			},
+			&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "csi-without-clone"}, Provisioner: "csi.example.com"},
+			&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "local"}, Provisioner: "rancher.io/local-path"},
+			&storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: "csi.example.com"}},
+		}
+
+		BeforeEach(func() {
+			for _, obj := range objects {
+				Expect(client.IgnoreAlreadyExists(k8sClient.Create(ctx, obj.DeepCopyObject().(client.Object)))).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			for _, obj := range objects {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, obj.DeepCopyObject().(client.Object)))).To(Succeed())
+			}
+		})
+
+		DescribeTable("should clone with the CSI driver only if it is possible",
+			func(method csv1alpha2.CloneMethod, storageClassName string, sourceStorageClassName string, expected csv1alpha2.CloneMethod) {
+				controllerReconciler := &CodeServerReconciler{
+					Client:   k8sClient,
+					Scheme:   k8sClient.Scheme(),
+					Recorder: record.NewFakeRecorder(100),
+				}
+				pvc := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &storageClassName}}
+				sourcePVC := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &sourceStorageClassName}}
+
+				resolved, err := controllerReconciler.resolveCloneMethod(ctx, method, pvc, sourcePVC)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resolved).To(Equal(expected))
+			},
+			Entry("CSI driver", csv1alpha2.CloneMethodAuto, "csi", "csi", csv1alpha2.CloneMethodCSIClone),
+			Entry("CSI driver not known to clone", csv1alpha2.CloneMethodAuto, "csi-without-clone", "csi-without-clone", csv1alpha2.CloneMethodCopy),
+			Entry("not a CSI driver", csv1alpha2.CloneMethodAuto, "local", "local", csv1alpha2.CloneMethodCopy),
+			Entry("different storage classes", csv1alpha2.CloneMethodAuto, "csi", "local", csv1alpha2.CloneMethodCopy),
+			Entry("explicit method", csv1alpha2.CloneMethodCSIClone, "local", "local", csv1alpha2.CloneMethodCSIClone),
+		)
+	})
+
+	Context("When sizing the clone", func() {
+		claim := func(request string, capacity string) corev1.PersistentVolumeClaim {
+			pvc := corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "mentor"},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(request)},
+					},
+				},
+			}
+			if capacity != "" {
+				pvc.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(capacity)}
+			}
+			return pvc
+		}
+
+		DescribeTable("should require the storage size to be at least the size of the source",
+			func(size string, sourceRequest string, sourceCapacity string, valid bool) {
+				err := validateCloneSize(claim(size, ""), claim(sourceRequest, sourceCapacity))
+				if valid {
+					Expect(err).NotTo(HaveOccurred())
+				} else {
+					Expect(err).To(HaveOccurred())
+				}
+			},
+			Entry("same size", "10Gi", "10Gi", "10Gi", true),
+			Entry("larger", "20Gi", "10Gi", "", true),
+			Entry("smaller", "5Gi", "10Gi", "", false),
+			Entry("smaller than the expanded capacity", "10Gi", "10Gi", "12Gi", false),
+		)
+	})
+
+	Context("When archiving the home directory", func() {
+		It("should use the deletion time in the object key", func() {
+			deletedAt := metav1.NewTime(time.Date(2024, 4, 1, 12, 30, 0, 0, time.UTC))
+			codeServer := csv1alpha2.CodeServer{
+				ObjectMeta: metav1.ObjectMeta{Name: "mentee", Namespace: "team-a", DeletionTimestamp: &deletedAt},
+				Spec: csv1alpha2.CodeServerSpec{
+					Archive: &csv1alpha2.ArchiveSpec{Bucket: "workspaces", Prefix: "archives/"},
+				},
+			}
+			Expect(archiveObjectKey(codeServer)).To(Equal("archives/team-a/mentee/20240401T123000Z.tar.gz"))
+		})
+	})
+
+	Context("When reclaiming the home directory", func() {
+		ctx := context.Background()
+
+		createCodeServer := func(name string, reclaimPolicy csv1alpha2.ReclaimPolicy) csv1alpha2.CodeServer {
+			codeServer := &csv1alpha2.CodeServer{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec: csv1alpha2.CodeServerSpec{
+					StorageSize:   "1Gi",
+					ReclaimPolicy: reclaimPolicy,
+					Archive: &csv1alpha2.ArchiveSpec{
+						Endpoint:              "http://minio.minio.svc:9000",
+						Bucket:                "workspaces",
+						CredentialsSecretName: "minio-credentials",
+						Image:                 "amazon/aws-cli:2.17.0",
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, codeServer)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, codeServer))).To(Succeed())
+			})
+			return *codeServer
+		}
+
+		newReconciler := func() *CodeServerReconciler {
+			return &CodeServerReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(100),
+			}
+		}
+
+		getPVC := func(name string) corev1.PersistentVolumeClaim {
+			var pvc corev1.PersistentVolumeClaim
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: name, Namespace: "default"}, &pvc)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, &pvc))).To(Succeed())
+			})
+			return pvc
+		}
+
+		DescribeTable("should not let the CodeServer own the PVC to be retained or archived",
+			func(name string, reclaimPolicy csv1alpha2.ReclaimPolicy, owned bool) {
+				codeServer := createCodeServer(name, reclaimPolicy)
+				Expect(newReconciler().reconcilePVC(ctx, codeServer)).To(BeNil())
+
+				pvc := getPVC(name)
+				if owned {
+					Expect(pvc.OwnerReferences).To(ConsistOf(HaveField("UID", codeServer.UID)))
+				} else {
+					Expect(pvc.OwnerReferences).To(BeEmpty())
+				}
+			},
+			Entry("Delete", "reclaim-delete", csv1alpha2.ReclaimPolicyDelete, true),
+			Entry("Retain", "reclaim-retain", csv1alpha2.ReclaimPolicyRetain, false),
+			Entry("Archive", "reclaim-archive", csv1alpha2.ReclaimPolicyArchive, false),
+		)
+
+		It("should label the retained PVC with the CodeServer", func() {
+			codeServer := createCodeServer("retained", csv1alpha2.ReclaimPolicyRetain)
+			controllerReconciler := newReconciler()
+			Expect(controllerReconciler.reconcilePVC(ctx, codeServer)).To(BeNil())
+
+			deletedAt := metav1.NewTime(time.Date(2024, 4, 1, 12, 30, 0, 0, time.UTC))
+			codeServer.DeletionTimestamp = &deletedAt
+			Expect(controllerReconciler.retainPVC(ctx, codeServer)).To(Succeed())
+
+			pvc := getPVC("retained")
+			Expect(pvc.OwnerReferences).To(BeEmpty())
+			Expect(pvc.Labels).To(HaveKeyWithValue(RetainedFromLabel, "retained"))
+			Expect(pvc.Annotations).To(HaveKeyWithValue(RetainedAtAnnotationKey, "2024-04-01T12:30:00Z"))
+		})
+
+		It("should run the archive job without the owner references", func() {
+			codeServer := createCodeServer("archived", csv1alpha2.ReclaimPolicyArchive)
+			controllerReconciler := newReconciler()
+			Expect(controllerReconciler.reconcilePVC(ctx, codeServer)).To(BeNil())
+			getPVC("archived")
+
+			deletedAt := metav1.NewTime(time.Date(2024, 4, 1, 12, 30, 0, 0, time.UTC))
+			codeServer.DeletionTimestamp = &deletedAt
+			archiving, _, err := controllerReconciler.reconcileArchiveJob(ctx, codeServer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(archiving).NotTo(BeNil())
+			Expect(archiving.Reason).To(Equal("Archiving"))
+
+			var job batchv1.Job
+			Expect(k8sClient.Get(ctx, client.ObjectKey{Name: "archived-archive", Namespace: "default"}, &job)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground)))).To(Succeed())
+			})
+			Expect(job.OwnerReferences).To(BeEmpty())
+			Expect(job.Spec.Template.Spec.InitContainers[0].Image).To(Equal(codeServer.Spec.Image))
+			Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("amazon/aws-cli:2.17.0"))
+			Expect(job.Spec.Template.Spec.Containers[0].Env).To(ContainElements(
+				corev1.EnvVar{Name: "ARCHIVE_URL", Value: "s3://workspaces/default/archived/20240401T123000Z.tar.gz"},
+				corev1.EnvVar{Name: "AWS_ENDPOINT_URL", Value: "http://minio.minio.svc:9000"},
+			))
+		})
+	})
+
+	Context("When adopting the PVC", func() {
+		ctx := context.Background()
+
+		DescribeTable("should adopt only the PVC created for the CodeServer",
+			func(labels map[string]string, conflict bool) {
+				pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "default", Labels: labels}}
+				controllerReconciler := &CodeServerReconciler{
+					Client:   fake.NewClientBuilder().WithObjects(pvc).Build(),
+					Recorder: record.NewFakeRecorder(10),
+				}
+				codeServer := csv1alpha2.CodeServer{
+					ObjectMeta: metav1.ObjectMeta{Name: "a", Namespace: "default"},
+					Spec:       csv1alpha2.CodeServerSpec{StorageSize: "1Gi", ReclaimPolicy: csv1alpha2.ReclaimPolicyRetain},
+				}
+
+				condition, err := controllerReconciler.reconcilePVC(ctx, codeServer)
+				Expect(err).NotTo(HaveOccurred())
+				if !conflict {
+					Expect(condition).To(BeNil())
+					return
+				}
+				Expect(condition).NotTo(BeNil())
+				Expect(condition.Reason).To(Equal("ClaimConflict"))
+				Expect(controllerReconciler.Get(ctx, client.ObjectKeyFromObject(pvc), pvc)).To(Succeed())
+				Expect(pvc.OwnerReferences).To(BeEmpty())
+			},
+			Entry("created for the CodeServer", map[string]string{
+				"app.kubernetes.io/instance":   "a",
+				"app.kubernetes.io/created-by": CodeServerManager,
+			}, false),
+			Entry("retained from the CodeServer", map[string]string{RetainedFromLabel: "a"}, false),
+			Entry("created for another CodeServer", map[string]string{
+				"app.kubernetes.io/instance":   "b",
+				"app.kubernetes.io/created-by": CodeServerManager,
+			}, true),
+			Entry("created by a user", nil, true),
+		)
+	})
+
+	Context("When deleting the stale resources", func() {
+		It("should delete only the resource controlled by the CodeServer", func() {
+			ctx := context.Background()
+			codeServer := csv1alpha2.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default", UID: "alice-uid"}}
+			owned := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+				Name:            "alice",
+				Namespace:       "default",
+				OwnerReferences: []metav1.OwnerReference{{Name: "alice", UID: "alice-uid", Controller: ptr.To(true)}},
+			}}
+			unowned := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "bob", Namespace: "default"}}
+			controllerReconciler := &CodeServerReconciler{Client: fake.NewClientBuilder().WithObjects(owned, unowned).Build()}
+
+			Expect(controllerReconciler.deleteOwned(ctx, codeServer, &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"}})).To(Succeed())
+			Expect(errors.IsNotFound(controllerReconciler.Get(ctx, client.ObjectKeyFromObject(owned), &networkingv1.Ingress{}))).To(BeTrue())
+
+			Expect(controllerReconciler.deleteOwned(ctx, codeServer, &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "bob", Namespace: "default"}})).To(Succeed())
+			Expect(controllerReconciler.Get(ctx, client.ObjectKeyFromObject(unowned), &networkingv1.Ingress{})).To(Succeed())
+
+			Expect(controllerReconciler.deleteOwned(ctx, codeServer, &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "carol", Namespace: "default"}})).To(Succeed())
+		})
+
+		It("should not delete the owner role without the owner unless the CodeServer controls it", func() {
+			ctx := context.Background()
+			codeServer := csv1alpha2.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default", UID: "alice-uid"}}
+			role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: ownerRoleName(codeServer), Namespace: "default"}}
+			controllerReconciler := &CodeServerReconciler{Client: fake.NewClientBuilder().WithObjects(role).Build()}
+
+			Expect(controllerReconciler.reconcileOwnerRBAC(ctx, codeServer)).To(Succeed())
+			Expect(controllerReconciler.Get(ctx, client.ObjectKeyFromObject(role), &rbacv1.Role{})).To(Succeed())
+
+			role.OwnerReferences = []metav1.OwnerReference{{Name: "alice", UID: "alice-uid", Controller: ptr.To(true)}}
+			Expect(controllerReconciler.Update(ctx, role)).To(Succeed())
+			Expect(controllerReconciler.reconcileOwnerRBAC(ctx, codeServer)).To(Succeed())
+			Expect(errors.IsNotFound(controllerReconciler.Get(ctx, client.ObjectKeyFromObject(role), &rbacv1.Role{}))).To(BeTrue())
+		})
+	})
+
+	Context("When rendering templates", func() {
+		codeServer := csv1alpha2.CodeServer{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "team-a", Labels: map[string]string{"team": "frontend"}},
+			Spec:       csv1alpha2.CodeServerSpec{Domain: "example.com"},
+		}
+
+		It("should render the name, namespace, labels and domain of the CodeServer", func() {
+			rendered, err := renderTemplate("{{ .Name }}-{{ .Namespace }}-{{ .Labels.team }}.{{ .Domain }}", codeServer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rendered).To(Equal("alice-team-a-frontend.example.com"))
+		})
+
+		It("should fail if a label is missing", func() {
+			_, err := renderTemplate("{{ .Labels.user }}", codeServer)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should render the host and path prefix of the Ingress", func() {
+			host, err := ingressHost(codeServer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(host).To(Equal("alice.example.com"))
+
+			pathBased := *codeServer.DeepCopy()
+			pathBased.Spec.PathPrefixTemplate = "/{{ .Namespace }}/{{ .Name }}/"
+			host, err = ingressHost(pathBased)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(host).To(Equal("example.com"))
+			prefix, err := ingressPathPrefix(pathBased)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(prefix).To(Equal("/team-a/alice"))
+
+			pathBased.Spec.HostTemplate = "code.{{ .Domain }}"
+			host, err = ingressHost(pathBased)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(host).To(Equal("code.example.com"))
+		})
+
+		It("should expose the proxy ports at subdomains", func() {
+			subdomain := *codeServer.DeepCopy()
+			subdomain.Spec.Exposure = csv1alpha2.ExposureIngress
+			subdomain.Spec.PublicProxyPorts = []int32{3000, 5173}
+			Expect(proxyHosts(subdomain, "alice.example.com")).To(BeEmpty())
+			Expect(pathProxyPorts(subdomain)).To(Equal([]int32{3000, 5173}))
+
+			subdomain.Spec.ProxyMode = csv1alpha2.ProxyModeSubdomain
+			Expect(proxyHosts(subdomain, "alice.example.com")).To(Equal([]string{"3000-alice.example.com", "5173-alice.example.com"}))
+			Expect(pathProxyPorts(subdomain)).To(BeEmpty())
+			Expect(proxyDomain(subdomain)).To(Equal("{{port}}-alice.example.com"))
+		})
+
+		It("should not route a host without the domain", func() {
+			withoutDomain := *codeServer.DeepCopy()
+			withoutDomain.Spec.Domain = ""
+			host, err := ingressHost(withoutDomain)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(host).To(BeEmpty())
+		})
+	})
+
+	Context("When exposing code server", func() {
+		It("should report the URL of the routed host", func() {
+			codeServer := csv1alpha2.CodeServer{
+				ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "team-a"},
+				Spec: csv1alpha2.CodeServerSpec{
+					Exposure:           csv1alpha2.ExposureIngress,
+					Domain:             "example.com",
+					PathPrefixTemplate: "/{{ .Namespace }}/{{ .Name }}",
+					TLS:                &csv1alpha2.IngressTLS{WildcardSecretName: "wildcard-tls"},
+				},
+			}
+			Expect(routedURL(codeServer)).To(Equal("https://example.com/team-a/alice/"))
+
+			codeServer.Spec.Exposure = csv1alpha2.ExposureNone
+			Expect(routedURL(codeServer)).To(BeEmpty())
+		})
+
+		DescribeTable("should report the URL of the service",
+			func(service corev1.Service, hostIP string, expected string) {
+				Expect(serviceURL(service, hostIP)).To(Equal(expected))
+			},
+			Entry("node port", corev1.Service{
+				Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort, Ports: []corev1.ServicePort{{Name: "http", Port: 19200, NodePort: 31000}}},
+			}, "192.168.0.10", "http://192.168.0.10:31000/"),
+			Entry("node port on an unknown node", corev1.Service{
+				Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort, Ports: []corev1.ServicePort{{Name: "http", Port: 19200, NodePort: 31000}}},
+			}, "", ""),
+			Entry("load balancer", corev1.Service{
+				Spec:   corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, Ports: []corev1.ServicePort{{Name: "http", Port: 19200}}},
+				Status: corev1.ServiceStatus{LoadBalancer: corev1.LoadBalancerStatus{Ingress: []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}}},
+			}, "", "http://lb.example.com:19200/"),
+			Entry("pending load balancer", corev1.Service{
+				Spec: corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer, Ports: []corev1.ServicePort{{Name: "http", Port: 19200}}},
+			}, "", ""),
+		)
+	})
+
+	Context("When discovering ports", func() {
+		codeServer := csv1alpha2.CodeServer{
+			Spec: csv1alpha2.CodeServerSpec{
+				ContainerPort:    19200,
+				PublicProxyPorts: []int32{8080, 3000},
+				PortDiscovery: &csv1alpha2.PortDiscovery{
+					Allow: []csv1alpha2.PortRange{{Start: 19198, End: 19201}, {Start: 5173}},
+					Deny:  []csv1alpha2.PortRange{{Start: 19201}},
+				},
+			},
+			Status: csv1alpha2.CodeServerStatus{DiscoveredPorts: []int32{3000, 5173}},
+		}
+
+		It("should scan the allowed ports except the port of code server", func() {
+			Expect(discoveryPorts(codeServer)).To(Equal([]int32{5173, 19198, 19199}))
+		})
+
+		It("should not scan the ports of oauth2-proxy and the sidecars", func() {
+			withSidecars := *codeServer.DeepCopy()
+			withSidecars.Spec.Auth = &csv1alpha2.CodeServerAuth{
+				Mode:        csv1alpha2.AuthModeOAuth2Proxy,
+				OAuth2Proxy: &csv1alpha2.OAuth2Proxy{Port: 19198},
+			}
+			withSidecars.Spec.Sidecars = []csv1alpha2.Sidecar{{
+				Container: corev1.Container{Name: "db", Ports: []corev1.ContainerPort{{ContainerPort: 5173}}},
+			}}
+			Expect(discoveryPorts(withSidecars)).To(Equal([]int32{19199}))
+		})
+
+		It("should scan the ports of the development servers by default", func() {
+			defaultRange := *codeServer.DeepCopy()
+			defaultRange.Spec.PortDiscovery = &csv1alpha2.PortDiscovery{}
+			ports := discoveryPorts(defaultRange)
+			Expect(ports).To(HaveLen(6000))
+			Expect(ports[0]).To(BeEquivalentTo(3000))
+			Expect(ports[len(ports)-1]).To(BeEquivalentTo(8999))
+		})
+
+		It("should expose the discovered ports after the public proxy ports", func() {
+			Expect(proxyPorts(codeServer)).To(Equal([]int32{8080, 3000, 5173}))
+		})
+
+		It("should expose the proxy ports up to the limit of HTTPRoute", func() {
+			manyPorts := *codeServer.DeepCopy()
+			manyPorts.Status.DiscoveredPorts = nil
+			for port := int32(4000); port < 4020; port++ {
+				manyPorts.Status.DiscoveredPorts = append(manyPorts.Status.DiscoveredPorts, port)
+			}
+			ports := proxyPorts(manyPorts)
+			Expect(ports).To(HaveLen(csv1alpha2.MaxProxyPorts))
+			Expect(ports[:2]).To(Equal([]int32{8080, 3000}))
+		})
+
+		It("should scan the pod in the background and notify the changed ports", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(listener.Close)
+			port := int32(listener.Addr().(*net.TCPAddr).Port)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			DeferCleanup(cancel)
+			scanner := newPortScanner()
+			go func() {
+				defer GinkgoRecover()
+				Expect(scanner.Start(ctx)).To(Succeed())
+			}()
+
+			key := types.NamespacedName{Name: "alice", Namespace: "default"}
+			scanner.Watch(key, portScanTarget{podIP: "127.0.0.1", ports: []int32{port}, interval: time.Minute})
+			var notified event.GenericEvent
+			Eventually(scanner.events, 5*time.Second).Should(Receive(&notified))
+			Expect(notified.Object.GetName()).To(Equal("alice"))
+
+			result, ok := scanner.Result(key)
+			Expect(ok).To(BeTrue())
+			Expect(result.ports).To(Equal([]int32{port}))
+
+			scanner.Forget(key)
+			_, ok = scanner.Result(key)
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should record the ports in the status only when they change", func() {
+			ctx := context.Background()
+			scheme := runtime.NewScheme()
+			Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+			Expect(csv1alpha2.AddToScheme(scheme)).To(Succeed())
+
+			scanned := codeServer.DeepCopy()
+			scanned.Name = "alice"
+			scanned.Namespace = "default"
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "alice-0", Namespace: "default", Labels: map[string]string{
+					"app.kubernetes.io/name":       CodeServer,
+					"app.kubernetes.io/instance":   "alice",
+					"app.kubernetes.io/created-by": CodeServerManager,
+				}},
+				Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+			}
+			controllerReconciler := &CodeServerReconciler{
+				Client:      fake.NewClientBuilder().WithScheme(scheme).WithObjects(scanned, pod).WithStatusSubresource(scanned).Build(),
+				portScanner: newPortScanner(),
+			}
+			Expect(controllerReconciler.Get(ctx, client.ObjectKeyFromObject(scanned), scanned)).To(Succeed())
+
+			By("waiting for the first scan")
+			Expect(controllerReconciler.reconcilePortDiscovery(ctx, scanned)).To(Succeed())
+			Expect(scanned.Status.DiscoveredPorts).To(Equal([]int32{3000, 5173}))
+
+			By("recording the ports found by the scan")
+			state := controllerReconciler.portScanner.states[client.ObjectKeyFromObject(scanned)]
+			state.result = &portScanResult{ports: []int32{5173}, scannedAt: time.Now()}
+			Expect(controllerReconciler.reconcilePortDiscovery(ctx, scanned)).To(Succeed())
+			Expect(scanned.Status.DiscoveredPorts).To(Equal([]int32{5173}))
+			Expect(scanned.Status.PortsScannedAt).NotTo(BeNil())
+			resourceVersion := scanned.ResourceVersion
+
+			By("leaving the status as it is if the ports have not changed")
+			state.result = &portScanResult{ports: []int32{5173}, scannedAt: time.Now()}
+			Expect(controllerReconciler.reconcilePortDiscovery(ctx, scanned)).To(Succeed())
+			Expect(scanned.ResourceVersion).To(Equal(resourceVersion))
+		})
+	})
+
+	Context("When authenticating the users", func() {
+		codeServer := csv1alpha2.CodeServer{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "team-a"},
+			Spec: csv1alpha2.CodeServerSpec{
+				ContainerPort: 19200,
+				Auth: &csv1alpha2.CodeServerAuth{
+					Mode:          csv1alpha2.AuthModeOAuth2Proxy,
+					AllowedEmails: []string{"alice@example.com"},
+					AllowedGroups: []string{"developers"},
+					OAuth2Proxy: &csv1alpha2.OAuth2Proxy{
+						IssuerURL:        "http://mock-oidc.default.svc:8080/default",
+						ClientID:         "code-server",
+						ClientSecretName: "oidc",
+						Image:            "quay.io/oauth2-proxy/oauth2-proxy:v7.7.1",
+						Port:             4180,
+						ExtraArgs:        []string{"--insecure-oidc-allow-unverified-email=true"},
+					},
+				},
+			},
+		}
+
+		It("should put oauth2-proxy in front of code server", func() {
+			Expect(servicePort(codeServer)).To(BeEquivalentTo(4180))
+
+			container, volume := oauth2ProxyContainer(codeServer)
+			Expect(container.Args).To(ContainElements(
+				"--http-address=0.0.0.0:4180",
+				"--upstream=http://127.0.0.1:19200/",
+				"--oidc-issuer-url=http://mock-oidc.default.svc:8080/default",
+				"--authenticated-emails-file=/etc/oauth2-proxy/authenticated-emails",
+				"--allowed-group=developers",
+				"--insecure-oidc-allow-unverified-email=true",
+			))
+			Expect(container.Args).NotTo(ContainElement("--email-domain=*"))
+			Expect(*volume.Secret.SecretName).To(Equal("alice"))
+		})
+
+		It("should only let oauth2-proxy connect to code server", func() {
+			Expect(bindAddress(codeServer)).To(Equal("127.0.0.1"))
+			Expect(probePort(codeServer)).To(Equal(intstr.FromInt32(4180)))
+			container, _ := oauth2ProxyContainer(codeServer)
+			Expect(container.Args).To(ContainElement("--skip-auth-route=^/healthz$"))
+
+			password := *codeServer.DeepCopy()
+			password.Spec.Auth = nil
+			Expect(bindAddress(password)).To(Equal("0.0.0.0"))
+			Expect(probePort(password)).To(Equal(intstr.FromString("http")))
+		})
+
+		It("should allow any email if only the groups are restricted", func() {
+			groupOnly := *codeServer.DeepCopy()
+			groupOnly.Spec.Auth.AllowedEmails = nil
+			container, volume := oauth2ProxyContainer(groupOnly)
+			Expect(container.Args).To(ContainElement("--email-domain=*"))
+			Expect(volume).To(BeNil())
+		})
+
+		It("should restrict the forward auth to the allowed users", func() {
+			forwardAuth := *codeServer.DeepCopy()
+			forwardAuth.Spec.Auth.Mode = csv1alpha2.AuthModeForwardAuth
+			forwardAuth.Spec.Auth.ForwardAuth = &csv1alpha2.ForwardAuth{
+				URL:             "https://oauth2-proxy.example.com/oauth2/auth",
+				SignInURL:       "https://oauth2-proxy.example.com/oauth2/start?rd=$escaped_request_uri",
+				ResponseHeaders: []string{"X-Auth-Request-Email"},
+			}
+			Expect(servicePort(forwardAuth)).To(BeEquivalentTo(19200))
+
+			annotations, err := forwardAuthAnnotations(forwardAuth)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(annotations).To(Equal(map[string]string{
+				"nginx.ingress.kubernetes.io/auth-url":              "https://oauth2-proxy.example.com/oauth2/auth?allowed_emails=alice%40example.com&allowed_groups=developers",
+				"nginx.ingress.kubernetes.io/auth-signin":           "https://oauth2-proxy.example.com/oauth2/start?rd=$escaped_request_uri",
+				"nginx.ingress.kubernetes.io/auth-response-headers": "X-Auth-Request-Email",
+			}))
+		})
+	})
+
+	Context("When isolating code server", func() {
+		codeServer := csv1alpha2.CodeServer{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "team-a"},
+			Spec: csv1alpha2.CodeServerSpec{
+				NetworkPolicy: &csv1alpha2.CodeServerNetworkPolicy{
+					IngressControllerNamespace: "ingress-nginx",
+					Activator:                  &csv1alpha2.NetworkPolicyPeer{Namespace: "code-server-operator-system", PodSelector: map[string]string{"app": "activator"}},
+					Egress:                     csv1alpha2.EgressPolicyOpen,
+				},
+			},
+		}
+
+		It("should allow ingress only from the ingress controller and the activator", func() {
+			spec := networkPolicySpec(codeServer, "code-server-operator-system")
+			Expect(spec.PolicyTypes).To(Equal([]networkingv1.PolicyType{networkingv1.PolicyTypeIngress}))
+			Expect(spec.Ingress).To(HaveLen(1))
+			Expect(spec.Ingress[0].From).To(HaveLen(2))
+			Expect(spec.Ingress[0].From[0].NamespaceSelector.MatchLabels).To(Equal(map[string]string{"kubernetes.io/metadata.name": "ingress-nginx"}))
+			Expect(spec.Ingress[0].From[1].PodSelector.MatchLabels).To(Equal(map[string]string{"app": "activator"}))
+		})
+
+		It("should allow the operator to scan the ports", func() {
+			discovery := *codeServer.DeepCopy()
+			discovery.Spec.PortDiscovery = &csv1alpha2.PortDiscovery{}
+			spec := networkPolicySpec(discovery, "code-server-operator-system")
+			Expect(spec.Ingress[0].From).To(HaveLen(3))
+			Expect(spec.Ingress[0].From[2].NamespaceSelector.MatchLabels).To(Equal(map[string]string{"kubernetes.io/metadata.name": "code-server-operator-system"}))
+			Expect(spec.Ingress[0].From[2].PodSelector.MatchLabels).To(Equal(map[string]string{"control-plane": "controller-manager"}))
+		})
+
+		It("should allow egress only to DNS and the allowlisted CIDRs", func() {
+			allowlist := *codeServer.DeepCopy()
+			allowlist.Spec.NetworkPolicy.Egress = csv1alpha2.EgressPolicyAllowlist
+			allowlist.Spec.NetworkPolicy.EgressCIDRs = []string{"10.0.0.0/8"}
+			spec := networkPolicySpec(allowlist, "code-server-operator-system")
+			Expect(spec.PolicyTypes).To(ContainElement(networkingv1.PolicyTypeEgress))
+			Expect(spec.Egress).To(HaveLen(2))
+			Expect(spec.Egress[0].Ports).To(HaveLen(2))
+			Expect(*spec.Egress[1].To[0].IPBlock.CIDR).To(Equal("10.0.0.0/8"))
+
+			allowlist.Spec.NetworkPolicy.Egress = csv1alpha2.EgressPolicyNone
+			spec = networkPolicySpec(allowlist, "code-server-operator-system")
+			Expect(spec.PolicyTypes).To(ContainElement(networkingv1.PolicyTypeEgress))
+			Expect(spec.Egress).To(BeEmpty())
+		})
+	})
+
+	Context("When managing the password", func() {
+		It("should version the password in an existing secret by its content", func() {
+			salt := []byte("salt")
+			version := passwordVersion([]byte("secret"), salt)
+			Expect(version).To(HaveLen(16))
+			Expect(passwordVersion([]byte("secret"), salt)).To(Equal(version))
+			Expect(passwordVersion([]byte("changed"), salt)).NotTo(Equal(version))
+			Expect(passwordVersion([]byte("secret"), []byte("another salt"))).NotTo(Equal(version))
+		})
+
+		now := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+		secret := corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.NewTime(now.Add(-2 * time.Hour))},
+		}
+
+		It("should rotate the password when the interval has passed or it is requested", func() {
+			codeServer := csv1alpha2.CodeServer{
+				Spec: csv1alpha2.CodeServerSpec{Password: &csv1alpha2.CodeServerPassword{RotationIntervalSeconds: ptr.To[int64](3 * 3600)}},
+			}
+			Expect(passwordRotationDue(codeServer, secret, now)).To(BeFalse())
+			Expect(nextPasswordRotation(codeServer, secret, now)).To(Equal(time.Hour))
+
+			rotated := *secret.DeepCopy()
+			rotated.Annotations = map[string]string{PasswordRotatedAtAnnotation: now.Add(-4 * time.Hour).Format(time.RFC3339)}
+			Expect(passwordRotationDue(codeServer, rotated, now)).To(BeTrue())
+
+			codeServer.Spec.Password = nil
+			codeServer.Annotations = map[string]string{RotatePasswordAnnotation: ""}
+			Expect(passwordRotationDue(codeServer, secret, now)).To(BeTrue())
+			Expect(nextPasswordRotation(codeServer, secret, now)).To(BeZero())
+		})
+
+		It("should pass the hashed password or the password in the existing secret", func() {
+			codeServer := csv1alpha2.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: "alice"}}
+			env := passwordEnv(codeServer)
+			Expect(*env.Name).To(Equal("PASSWORD"))
+			Expect(*env.ValueFrom.SecretKeyRef.Name).To(Equal("alice"))
+			Expect(*env.ValueFrom.SecretKeyRef.Key).To(Equal(PasswordKey))
+
+			codeServer.Spec.Password = &csv1alpha2.CodeServerPassword{SecretName: "shared", Key: "code-server"}
+			env = passwordEnv(codeServer)
+			Expect(*env.ValueFrom.SecretKeyRef.Name).To(Equal("shared"))
+			Expect(*env.ValueFrom.SecretKeyRef.Key).To(Equal("code-server"))
+
+			codeServer.Spec.Password.Hashed = true
+			env = passwordEnv(codeServer)
+			Expect(*env.Name).To(Equal("HASHED_PASSWORD"))
+			Expect(*env.ValueFrom.SecretKeyRef.Name).To(Equal("alice"))
+			Expect(*env.ValueFrom.SecretKeyRef.Key).To(Equal(HashedPasswordKey))
+		})
+	})
+
+	Context("When measuring the time to ready", func() {
+		DescribeTable("should tell whether code server is being created",
+			func(phase csv1alpha2.CodeServerPhase, ready *metav1.Condition, expected string) {
+				codeServer := csv1alpha2.CodeServer{Status: csv1alpha2.CodeServerStatus{Phase: phase}}
+				if ready != nil {
+					codeServer.Status.Conditions = []metav1.Condition{*ready}
+				}
+				Expect(notReadyReason(codeServer)).To(Equal(expected))
+			},
+			Entry("new", csv1alpha2.CodeServerPhase(""), nil, "Creating"),
+			Entry("copied", csv1alpha2.CodeServerNotReady,
+				&metav1.Condition{Type: csv1alpha2.ConditionTypeReady, Status: metav1.ConditionFalse, Reason: "Copying"}, "Creating"),
+			Entry("crashed", csv1alpha2.CodeServerReady,
+				&metav1.Condition{Type: csv1alpha2.ConditionTypeReady, Status: metav1.ConditionTrue, Reason: "PodReady"}, "PodNotReady"),
+		)
+	})
+
+	Context("When recording the events", func() {
+		DescribeTable("should record the transition of the phase",
+			func(current csv1alpha2.CodeServerPhase, next csv1alpha2.CodeServerPhase, expected []string) {
+				recorder := record.NewFakeRecorder(10)
+				reconciler := &CodeServerReconciler{Recorder: recorder}
+				codeServer := csv1alpha2.CodeServer{
+					ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"},
+					Status:     csv1alpha2.CodeServerStatus{Phase: current},
+				}
+				reconciler.recordTransition(codeServer, csv1alpha2.CodeServerStatus{Phase: next}, time.Now())
+
+				close(recorder.Events)
+				var events []string
+				for event := range recorder.Events {
+					events = append(events, event)
+				}
+				Expect(events).To(Equal(expected))
+			},
+			Entry("ready", csv1alpha2.CodeServerNotReady, csv1alpha2.CodeServerReady,
+				[]string{"Normal Ready Code server is ready"}),
+			Entry("not ready", csv1alpha2.CodeServerReady, csv1alpha2.CodeServerNotReady,
+				[]string{"Warning NotReady Code server has become not ready"}),
+			Entry("unchanged", csv1alpha2.CodeServerReady, csv1alpha2.CodeServerReady, nil),
+		)
+	})
+
+	Context("When inspecting the pods", func() {
+		pendingClaim := corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice-home"},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+		}
+		boundClaim := corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "alice-home"},
+			Status:     corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+		}
+		unschedulable := corev1.PodStatus{
+			Conditions: []corev1.PodCondition{{
+				Type:    corev1.PodScheduled,
+				Status:  corev1.ConditionFalse,
+				Reason:  corev1.PodReasonUnschedulable,
+				Message: "0/3 nodes are available",
+			}},
+		}
+
+		DescribeTable("should report the failure of the pod",
+			func(podStatus corev1.PodStatus, pvc corev1.PersistentVolumeClaim, status metav1.ConditionStatus, reason string, message string) {
+				pod := corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "alice-0"}, Status: podStatus}
+				condition := observePods(csv1alpha2.CodeServer{}, []corev1.Pod{pod}, pvc)
+				Expect(condition.Type).To(Equal(csv1alpha2.ConditionTypePodHealthy))
+				Expect(condition.Status).To(Equal(status))
+				Expect(condition.Reason).To(Equal(reason))
+				Expect(condition.Message).To(Equal(message))
+			},
+			Entry("running", corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{Name: "code-server", State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}}},
+			}, boundClaim, metav1.ConditionTrue, "Healthy", "no failure is found in code server pod"),
+			Entry("unschedulable", unschedulable, boundClaim,
+				metav1.ConditionFalse, "Unschedulable", "pod alice-0 cannot be scheduled: 0/3 nodes are available"),
+			Entry("pending claim", unschedulable, pendingClaim,
+				metav1.ConditionFalse, "PVCPending", "persistent volume claim alice-home is pending: 0/3 nodes are available"),
+			Entry("failed init container", corev1.PodStatus{
+				InitContainerStatuses: []corev1.ContainerStatus{
+					{Name: "copy-home", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}},
+					{
+						Name:                 "git",
+						State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+						LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 128}},
+					},
+				},
+			}, boundClaim, metav1.ConditionFalse, "InitContainerFailed", `init container "git" exited with code 128`),
+			Entry("image pull", corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "code-server",
+					Image: "codercom/code-server:missing",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "not found"}},
+				}},
+			}, boundClaim, metav1.ConditionFalse, "ImagePullBackOff", `image "codercom/code-server:missing" of container "code-server" cannot be pulled: not found`),
+			Entry("crash loop", corev1.PodStatus{
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:                 "code-server",
+					State:                corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+					LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1}},
+				}},
+			}, boundClaim, metav1.ConditionFalse, "CrashLoopBackOff", `container "code-server" is crashing: exited with code 1`),
+		)
+
+		It("should inspect the newest pod first", func() {
+			now := metav1.Now()
+			old := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "alice-old", CreationTimestamp: metav1.NewTime(now.Add(-time.Hour))},
+				Status:     unschedulable,
+			}
+			crashing := corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "alice-new", CreationTimestamp: now},
+				Status: corev1.PodStatus{ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  "code-server",
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+				}}},
+			}
+			condition := observePods(csv1alpha2.CodeServer{}, []corev1.Pod{old, crashing}, boundClaim)
+			Expect(condition.Reason).To(Equal("CrashLoopBackOff"))
+		})
+
+		DescribeTable("should back off requeueing code server which is not ready",
+			func(elapsed time.Duration, expected time.Duration) {
+				Expect(notReadyRequeueAfter(elapsed)).To(Equal(expected))
+			},
+			Entry("just created", time.Duration(0), 5*time.Second),
+			Entry("a minute", time.Minute, 30*time.Second),
+			Entry("an hour", time.Hour, 5*time.Minute),
+		)
+
+		It("should record the failure once until its cause changes", func() {
+			failed := func(message string) csv1alpha2.CodeServerStatus {
+				return csv1alpha2.CodeServerStatus{
+					Phase: csv1alpha2.CodeServerNotReady,
+					Conditions: []metav1.Condition{{
+						Type:    csv1alpha2.ConditionTypePodHealthy,
+						Status:  metav1.ConditionFalse,
+						Reason:  "InitContainerFailed",
+						Message: message,
+					}},
+				}
+			}
+			recorder := record.NewFakeRecorder(10)
+			reconciler := &CodeServerReconciler{Recorder: recorder}
+			codeServer := csv1alpha2.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "default"}}
+
+			codeServer.Status = csv1alpha2.CodeServerStatus{Phase: csv1alpha2.CodeServerNotReady}
+			reconciler.recordTransition(codeServer, failed(`init container "git" exited with code 128`), time.Now())
+			codeServer.Status = failed(`init container "git" exited with code 128`)
+			reconciler.recordTransition(codeServer, failed(`init container "git" exited with code 128`), time.Now())
+			reconciler.recordTransition(codeServer, failed(`init container "git" exited with code 1`), time.Now())
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			Expect(events).To(Equal([]string{
+				`Warning InitContainerFailed init container "git" exited with code 128`,
+				`Warning InitContainerFailed init container "git" exited with code 1`,
+			}))
+		})
+	})
+
+	Context("When owning code server", func() {
+		DescribeTable("should convert the name of the owner into a label value",
+			func(name string, expected string) {
+				Expect(ownerLabelValue(name)).To(Equal(expected))
+			},
+			Entry("user name", "alice", "alice"),
+			Entry("email", "alice@example.com", "alice_example.com"),
+			Entry("prefixed group", "oidc:developers", "oidc_developers"),
+			Entry("trailing invalid character", "alice@", "alice"),
+			Entry("long name", strings.Repeat("a", 70), strings.Repeat("a", 54)+"-6bd5e503"),
+		)
+
+		It("should label the kind of the owner", func() {
+			codeServer := csv1alpha2.CodeServer{
+				Spec: csv1alpha2.CodeServerSpec{Owner: &csv1alpha2.CodeServerOwner{Name: "developers", Kind: csv1alpha2.OwnerKindGroup}},
+			}
+			Expect(ownerLabels(codeServer)).To(Equal(map[string]string{
+				OwnerLabel:     "developers",
+				OwnerKindLabel: "Group",
+			}))
+
+			codeServer.Spec.Owner = nil
+			Expect(ownerLabels(codeServer)).To(BeNil())
+		})
+
+		It("should only grant the owner to get the CodeServer and the secret of its password", func() {
+			codeServer := csv1alpha2.CodeServer{
+				ObjectMeta: metav1.ObjectMeta{Name: "alice"},
+				Spec:       csv1alpha2.CodeServerSpec{Owner: &csv1alpha2.CodeServerOwner{Name: "alice"}},
+			}
+			rules := ownerRoleRules(codeServer)
+			Expect(rules).To(HaveLen(2))
+			for _, rule := range rules {
+				Expect(rule.Verbs).To(Equal([]string{"get"}))
+				Expect(rule.ResourceNames).To(Equal([]string{"alice"}))
+			}
+			Expect(rules[1].Resources).To(Equal([]string{"secrets"}))
+
+			codeServer.Spec.Password = &csv1alpha2.CodeServerPassword{SecretName: "alice-password"}
+			rules = ownerRoleRules(codeServer)
+			Expect(rules[0].ResourceNames).To(Equal([]string{"alice"}))
+			Expect(rules[1].ResourceNames).To(Equal([]string{"alice-password"}))
+		})
+	})
+
+	Context("When routing with HTTPRoute", func() {
+		It("should rewrite the path prefix to the path of code server", func() {
+			rule := httpRouteRule("alice", "/team-a/alice", "/proxy/3000", 3000)
+			Expect(*rule.Matches[0].Path.Value).To(Equal("/team-a/alice/proxy/3000"))
+			Expect(*rule.Filters[0].URLRewrite.Path.ReplacePrefixMatch).To(Equal("/proxy/3000"))
+			Expect(*rule.BackendRefs[0].Port).To(BeEquivalentTo(3000))
+
+			rule = httpRouteRule("alice", "", "/", 19200)
+			Expect(*rule.Matches[0].Path.Value).To(Equal("/"))
+			Expect(rule.Filters).To(BeEmpty())
+		})
+
+		DescribeTable("should report the RouteAccepted condition",
+			func(parents []gatewayv1.RouteParentStatus, status metav1.ConditionStatus, reason string) {
+				codeServer := csv1alpha2.CodeServer{
+					Spec: csv1alpha2.CodeServerSpec{Gateway: &csv1alpha2.GatewayReference{Name: "shared", Namespace: "gateway"}},
+				}
+				route := gatewayv1.HTTPRoute{
+					ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "team-a", Generation: 2},
+					Status:     gatewayv1.HTTPRouteStatus{RouteStatus: gatewayv1.RouteStatus{Parents: parents}},
+				}
+				condition := routeCondition(codeServer, route)
+				Expect(condition.Status).To(Equal(status))
+				Expect(condition.Reason).To(Equal(reason))
+			},
+			Entry("not yet observed", nil, metav1.ConditionUnknown, "Pending"),
+			Entry("accepted by another gateway", []gatewayv1.RouteParentStatus{
+				routeParentStatus("other", metav1.ConditionTrue, "Accepted", 2),
+			}, metav1.ConditionUnknown, "Pending"),
+			Entry("outdated", []gatewayv1.RouteParentStatus{
+				routeParentStatus("shared", metav1.ConditionTrue, "Accepted", 1),
+			}, metav1.ConditionUnknown, "Pending"),
+			Entry("not allowed", []gatewayv1.RouteParentStatus{
+				routeParentStatus("shared", metav1.ConditionFalse, "NotAllowedByListeners", 2),
+			}, metav1.ConditionFalse, "NotAllowedByListeners"),
+			Entry("accepted", []gatewayv1.RouteParentStatus{
+				routeParentStatus("shared", metav1.ConditionTrue, "Accepted", 2),
+			}, metav1.ConditionTrue, "Accepted"),
+		)
+
+		It("should report the HTTPRoute not yet created as pending", func() {
+			scheme := runtime.NewScheme()
+			Expect(gatewayv1.Install(scheme)).To(Succeed())
+			controllerReconciler := &CodeServerReconciler{
+				Client:           fake.NewClientBuilder().WithScheme(scheme).Build(),
+				GatewayAvailable: true,
+			}
+			codeServer := csv1alpha2.CodeServer{
+				ObjectMeta: metav1.ObjectMeta{Name: "alice", Namespace: "team-a"},
+				Spec: csv1alpha2.CodeServerSpec{
+					Exposure: csv1alpha2.ExposureIngress,
+					Routing:  csv1alpha2.RoutingHTTPRoute,
+					Domain:   "example.com",
+					Gateway:  &csv1alpha2.GatewayReference{Name: "shared", Namespace: "gateway"},
+				},
+			}
+
+			condition, err := controllerReconciler.observeHTTPRoute(context.Background(), codeServer)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionUnknown))
+			Expect(condition.Reason).To(Equal("Pending"))
+		})
+	})
 })
+
+func routeParentStatus(gateway string, status metav1.ConditionStatus, reason string, observedGeneration int64) gatewayv1.RouteParentStatus {
+	return gatewayv1.RouteParentStatus{
+		ParentRef: gatewayv1.ParentReference{Name: gatewayv1.ObjectName(gateway), Namespace: ptr.To(gatewayv1.Namespace("gateway"))},
+		Conditions: []metav1.Condition{{
+			Type:               string(gatewayv1.RouteConditionAccepted),
+			Status:             status,
+			Reason:             reason,
+			ObservedGeneration: observedGeneration,
+		}},
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// serviceType returns the type of code server service for the exposure.
+func serviceType(exposure csv1alpha2.Exposure) corev1.ServiceType {
+	switch exposure {
+	case csv1alpha2.ExposureNodePort:
+		return corev1.ServiceTypeNodePort
+	case csv1alpha2.ExposureLoadBalancer:
+		return corev1.ServiceTypeLoadBalancer
+	default:
+		return corev1.ServiceTypeClusterIP
+	}
+}
+
+// publicURL returns the URL code server is exposed at, or empty if it is not exposed or the address is not assigned yet.
+func (r *CodeServerReconciler) publicURL(ctx context.Context, codeServer csv1alpha2.CodeServer) (string, error) {
+	switch codeServer.Spec.Exposure {
+	case csv1alpha2.ExposureIngress:
+		return routedURL(codeServer)
+	case csv1alpha2.ExposureNodePort, csv1alpha2.ExposureLoadBalancer:
+	default:
+		return "", nil
+	}
+
+	var service corev1.Service
+	if err := r.Get(ctx, client.ObjectKey{Name: codeServer.Name, Namespace: codeServer.Namespace}, &service); err != nil {
+		return "", fmt.Errorf("failed to get service: %w", err)
+	}
+
+	// A node port is open on every node, so the node running code server pod is used as the address.
+	var hostIP string
+	if codeServer.Spec.Exposure == csv1alpha2.ExposureNodePort {
+		var pods corev1.PodList
+		if err := r.List(ctx, &pods, client.InNamespace(codeServer.Namespace), client.MatchingLabels{
+			"app.kubernetes.io/name":       CodeServer,
+			"app.kubernetes.io/instance":   codeServer.Name,
+			"app.kubernetes.io/created-by": CodeServerManager,
+		}); err != nil {
+			return "", fmt.Errorf("failed to list pods: %w", err)
+		}
+		for _, pod := range pods.Items {
+			if pod.Status.HostIP != "" {
+				hostIP = pod.Status.HostIP
+				break
+			}
+		}
+	}
+
+	return serviceURL(service, hostIP), nil
+}
+
+// routedURL returns the URL of the host and path prefix routed by the Ingress or HTTPRoute.
+func routedURL(codeServer csv1alpha2.CodeServer) (string, error) {
+	host, err := routedHost(codeServer)
+	if err != nil || host == "" {
+		return "", err
+	}
+	pathPrefix, err := ingressPathPrefix(codeServer)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := "http"
+	if codeServer.Spec.TLS != nil {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: host, Path: pathPrefix + "/"}).String(), nil
+}
+
+// serviceURL returns the URL of the http port of the NodePort service on hostIP, or of the LoadBalancer service.
+func serviceURL(service corev1.Service, hostIP string) string {
+	var port corev1.ServicePort
+	for _, p := range service.Spec.Ports {
+		if p.Name == "http" {
+			port = p
+			break
+		}
+	}
+
+	var address string
+	var portNumber int32
+	switch service.Spec.Type {
+	case corev1.ServiceTypeNodePort:
+		address = hostIP
+		portNumber = port.NodePort
+	case corev1.ServiceTypeLoadBalancer:
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			address = ingress.IP
+			if address == "" {
+				address = ingress.Hostname
+			}
+			if address != "" {
+				break
+			}
+		}
+		portNumber = port.Port
+	}
+	if address == "" || portNumber == 0 {
+		return ""
+	}
+
+	return (&url.URL{Scheme: "http", Host: net.JoinHostPort(address, strconv.Itoa(int(portNumber))), Path: "/"}).String()
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	gatewayv1apply "sigs.k8s.io/gateway-api/apis/applyconfiguration/apis/v1"
+	gatewayv1 "sigs.k8s.io/gateway-api/apis/v1"
+)
+
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
+
+// reconcileHTTPRoute creates the HTTPRoute attached to the parent Gateway if Routing is HTTPRoute,
+// and deletes the stale HTTPRoute otherwise.
+func (r *CodeServerReconciler) reconcileHTTPRoute(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	if !r.GatewayAvailable {
+		if codeServer.Spec.Routing == csv1alpha2.RoutingHTTPRoute {
+			logger.Info("Gateway API CRDs are not installed, skipping HTTPRoute.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+		}
+		return nil
+	}
+
+	host, err := routedHost(codeServer)
+	if err != nil {
+		return fmt.Errorf("failed to render host: %w", err)
+	}
+
+	if host == "" || codeServer.Spec.Routing != csv1alpha2.RoutingHTTPRoute || codeServer.Spec.Gateway == nil {
+		route := &gatewayv1.HTTPRoute{ObjectMeta: metav1.ObjectMeta{Name: codeServer.Name, Namespace: codeServer.Namespace}}
+		if err := r.deleteOwned(ctx, codeServer, route); err != nil {
+			return fmt.Errorf("failed to delete HTTPRoute: %w", err)
+		}
+		return nil
+	}
+
+	owner, err := controllerReference(codeServer, r.Scheme)
+	if err != nil {
+		return fmt.Errorf("failed to create controller reference: %w", err)
+	}
+	pathPrefix, err := ingressPathPrefix(codeServer)
+	if err != nil {
+		return fmt.Errorf("failed to render path prefix: %w", err)
+	}
+
+	rules := []*gatewayv1apply.HTTPRouteRuleApplyConfiguration{
+		httpRouteRule(codeServer.Name, pathPrefix, "/", codeServer.Spec.ContainerPort),
+	}
+	for _, port := range pathProxyPorts(codeServer) {
+		backendPort := port
+		if authMode(codeServer) == csv1alpha2.AuthModeOAuth2Proxy {
+			backendPort = codeServer.Spec.ContainerPort
+		}
+		rules = append(rules, httpRouteRule(codeServer.Name, pathPrefix, fmt.Sprintf("/proxy/%d", port), backendPort))
+	}
+
+	// The proxy hosts are routed to code server by the same rule as the host.
+	hostnames := []gatewayv1.Hostname{gatewayv1.Hostname(host)}
+	for _, proxyHost := range proxyHosts(codeServer, host) {
+		hostnames = append(hostnames, gatewayv1.Hostname(proxyHost))
+	}
+
+	parentRef := gatewayv1apply.ParentReference().
+		WithName(gatewayv1.ObjectName(codeServer.Spec.Gateway.Name))
+	if codeServer.Spec.Gateway.Namespace != "" {
+		parentRef.WithNamespace(gatewayv1.Namespace(codeServer.Spec.Gateway.Namespace))
+	}
+	if codeServer.Spec.Gateway.SectionName != "" {
+		parentRef.WithSectionName(gatewayv1.SectionName(codeServer.Spec.Gateway.SectionName))
+	}
+
+	route := gatewayv1apply.HTTPRoute(codeServer.Name, codeServer.Namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/name":       CodeServer,
+			"app.kubernetes.io/instance":   codeServer.Name,
+			"app.kubernetes.io/created-by": CodeServerManager,
+		}).
+		WithLabels(ownerLabels(codeServer)).
+		WithOwnerReferences(owner).
+		WithSpec(gatewayv1apply.HTTPRouteSpec().
+			WithParentRefs(parentRef).
+			WithHostnames(hostnames...).
+			WithRules(rules...),
+		)
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(route)
+	if err != nil {
+		return fmt.Errorf("failed to convert HTTPRoute to unstructured: %w", err)
+	}
+
+	patch := &unstructured.Unstructured{
+		Object: obj,
+	}
+
+	var current gatewayv1.HTTPRoute
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: codeServer.Namespace, Name: codeServer.Name}, &current)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get HTTPRoute: %w", err)
+	}
+
+	currentApplyConfig, err := gatewayv1apply.ExtractHTTPRoute(&current, CodeServerManager)
+	if err != nil {
+		return fmt.Errorf("failed to extract apply configuration from HTTPRoute: %w", err)
+	}
+
+	if equality.Semantic.DeepEqual(route, currentApplyConfig) {
+		return nil
+	}
+
+	if err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
+		return fmt.Errorf("failed to apply HTTPRoute: %w", err)
+	}
+
+	logger.Info("HTTPRoute has been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+	if current.CreationTimestamp.IsZero() {
+		r.recordCreated(&codeServer, "HTTPRoute", codeServer.Name)
+	}
+
+	return nil
+}
+
+// httpRouteRule returns the rule that routes path under pathPrefix to port of code server service.
+// pathPrefix is replaced with path so that code server receives the same path as with its own host.
+func httpRouteRule(serviceName string, pathPrefix string, path string, port int32) *gatewayv1apply.HTTPRouteRuleApplyConfiguration {
+	matchPath := path
+	if pathPrefix != "" {
+		matchPath = pathPrefix
+		if path != "/" {
+			matchPath += path
+		}
+	}
+
+	rule := gatewayv1apply.HTTPRouteRule().
+		WithMatches(gatewayv1apply.HTTPRouteMatch().
+			WithPath(gatewayv1apply.HTTPPathMatch().
+				WithType(gatewayv1.PathMatchPathPrefix).
+				WithValue(matchPath),
+			),
+		).
+		WithBackendRefs(gatewayv1apply.HTTPBackendRef().
+			WithName(gatewayv1.ObjectName(serviceName)).
+			WithPort(gatewayv1.PortNumber(port)),
+		)
+
+	if pathPrefix != "" {
+		rule.WithFilters(gatewayv1apply.HTTPRouteFilter().
+			WithType(gatewayv1.HTTPRouteFilterURLRewrite).
+			WithURLRewrite(gatewayv1apply.HTTPURLRewriteFilter().
+				WithPath(gatewayv1apply.HTTPPathModifier().
+					WithType(gatewayv1.PrefixMatchHTTPPathModifier).
+					WithReplacePrefixMatch(path),
+				),
+			),
+		)
+	}
+
+	return rule
+}
+
+// observeHTTPRoute returns the RouteAccepted condition, or nil if code server is not routed with HTTPRoute.
+func (r *CodeServerReconciler) observeHTTPRoute(ctx context.Context, codeServer csv1alpha2.CodeServer) (*metav1.Condition, error) {
+	host, err := routedHost(codeServer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render host: %w", err)
+	}
+	if host == "" || codeServer.Spec.Routing != csv1alpha2.RoutingHTTPRoute {
+		return nil, nil
+	}
+
+	if !r.GatewayAvailable {
+		return &metav1.Condition{
+			Type:               csv1alpha2.ConditionTypeRouteAccepted,
+			Status:             metav1.ConditionFalse,
+			Reason:             "GatewayAPINotInstalled",
+			Message:            "Gateway API CRDs are not installed in the cluster",
+			ObservedGeneration: codeServer.Generation,
+		}, nil
+	}
+
+	var route gatewayv1.HTTPRoute
+	err = r.Get(ctx, client.ObjectKey{Name: codeServer.Name, Namespace: codeServer.Namespace}, &route)
+	if errors.IsNotFound(err) {
+		// The cache may not have observed the HTTPRoute created in this reconciliation yet.
+		return &metav1.Condition{
+			Type:               csv1alpha2.ConditionTypeRouteAccepted,
+			Status:             metav1.ConditionUnknown,
+			Reason:             "Pending",
+			Message:            "waiting for the HTTPRoute to be created",
+			ObservedGeneration: codeServer.Generation,
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HTTPRoute: %w", err)
+	}
+
+	condition := routeCondition(codeServer, route)
+	return &condition, nil
+}
+
+// routeCondition returns the RouteAccepted condition from the Accepted condition reported by the parent Gateway.
+func routeCondition(codeServer csv1alpha2.CodeServer, route gatewayv1.HTTPRoute) metav1.Condition {
+	condition := metav1.Condition{
+		Type:               csv1alpha2.ConditionTypeRouteAccepted,
+		Status:             metav1.ConditionUnknown,
+		Reason:             "Pending",
+		Message:            "waiting for the Gateway to accept the HTTPRoute",
+		ObservedGeneration: codeServer.Generation,
+	}
+
+	gateway := codeServer.Spec.Gateway
+	if gateway == nil {
+		return condition
+	}
+	gatewayNamespace := gateway.Namespace
+	if gatewayNamespace == "" {
+		gatewayNamespace = route.Namespace
+	}
+
+	for _, parent := range route.Status.Parents {
+		if string(parent.ParentRef.Name) != gateway.Name || string(ptr.Deref(parent.ParentRef.Namespace, gatewayv1.Namespace(route.Namespace))) != gatewayNamespace {
+			continue
+		}
+		accepted := meta.FindStatusCondition(parent.Conditions, string(gatewayv1.RouteConditionAccepted))
+		if accepted == nil || accepted.ObservedGeneration < route.Generation {
+			continue
+		}
+		condition.Status = accepted.Status
+		condition.Reason = accepted.Reason
+		condition.Message = accepted.Message
+		break
+	}
+
+	return condition
+}
+
+// GatewayAvailable reports whether the Gateway API CRDs are installed in the cluster.
+func GatewayAvailable(mapper meta.RESTMapper) (bool, error) {
+	_, err := mapper.RESTMapping(schema.GroupKind{Group: gatewayv1.GroupName, Kind: "HTTPRoute"}, gatewayv1.GroupVersion.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
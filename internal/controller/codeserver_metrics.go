@@ -0,0 +1,93 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	"github.com/walnuts1018/code-server-operator/internal/initplugins"
+	initpluginsCommon "github.com/walnuts1018/code-server-operator/internal/initplugins/common"
+	"github.com/walnuts1018/code-server-operator/internal/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// reasonCreating is the reason of the Ready condition until new code server becomes ready for the first time.
+	reasonCreating = "Creating"
+	// reasonPodNotReady is the reason of the Ready condition while code server pod is not ready otherwise.
+	reasonPodNotReady = "PodNotReady"
+)
+
+// notReadyReason returns the reason of the Ready condition while code server pod is not ready,
+// which tells whether code server is being created to measure the time to ready.
+func notReadyReason(codeServer csv1alpha2.CodeServer) string {
+	ready := meta.FindStatusCondition(codeServer.Status.Conditions, csv1alpha2.ConditionTypeReady)
+	if ready == nil {
+		return reasonCreating
+	}
+	if ready.Status == metav1.ConditionFalse {
+		switch ready.Reason {
+		case reasonCreating, "Copying", "CopyFailed":
+			return reasonCreating
+		}
+	}
+	return reasonPodNotReady
+}
+
+// recordTransition records the metrics and events of the transition of the status of code server from current to next at now.
+func (r *CodeServerReconciler) recordTransition(codeServer csv1alpha2.CodeServer, next csv1alpha2.CodeServerStatus, now time.Time) {
+	current := codeServer.Status
+	if current.Phase == csv1alpha2.CodeServerReady && next.Phase == csv1alpha2.CodeServerNotReady {
+		r.Recorder.Event(&codeServer, corev1.EventTypeWarning, "NotReady", "Code server has become not ready")
+	}
+	if failure := meta.FindStatusCondition(next.Conditions, csv1alpha2.ConditionTypePodHealthy); failure != nil && failure.Status == metav1.ConditionFalse {
+		// The failure is recorded once until its cause changes.
+		previous := meta.FindStatusCondition(current.Conditions, csv1alpha2.ConditionTypePodHealthy)
+		if previous == nil || previous.Reason != failure.Reason || previous.Message != failure.Message {
+			r.Recorder.Event(&codeServer, corev1.EventTypeWarning, failure.Reason, failure.Message)
+		}
+	}
+
+	if current.Phase == csv1alpha2.CodeServerReady || next.Phase != csv1alpha2.CodeServerReady {
+		return
+	}
+	r.Recorder.Event(&codeServer, corev1.EventTypeNormal, "Ready", "Code server is ready")
+
+	ready := meta.FindStatusCondition(current.Conditions, csv1alpha2.ConditionTypeReady)
+	if ready != nil && ready.Status == metav1.ConditionFalse && ready.Reason == reasonCreating {
+		metrics.ObserveTimeToReady(codeServer.Namespace, codeServer.CreationTimestamp.Time, now)
+	}
+}
+
+// recordInitPluginFailures counts the failures of the init plugins in the pods of code server.
+func (r *CodeServerReconciler) recordInitPluginFailures(codeServer csv1alpha2.CodeServer, pods []corev1.Pod) error {
+	plugins, err := initplugins.PluginNames(codeServer.Spec.InitPlugins, initpluginsCommon.CommonFields{
+		Image:      codeServer.Spec.Image,
+		VolumeName: "home",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create init plugins: %w", err)
+	}
+
+	metrics.RecordInitPluginFailures(client.ObjectKeyFromObject(&codeServer), pods, plugins)
+	return nil
+}
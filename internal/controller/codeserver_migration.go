@@ -0,0 +1,80 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// migrateLegacyStatus rewrites the legacy status of the CodeServer, which was the phase string itself, into an object.
+// The legacy status does not match the schema, so an apiserver without validation ratcheting rejects every update of
+// the CodeServer until its status is migrated with the status subresource, which only validates the new status.
+func migrateLegacyStatus(ctx context.Context, c client.Client, codeServer *csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	// The legacy status is decoded into a phase without conditions, which the controller never writes.
+	if codeServer.Status.Phase == "" || len(codeServer.Status.Conditions) > 0 {
+		return nil
+	}
+
+	// Unstructured objects are not cached, so the stored form of the status is read.
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(csv1alpha2.GroupVersion.WithKind("CodeServer"))
+	if err := c.Get(ctx, client.ObjectKeyFromObject(codeServer), obj); err != nil {
+		return fmt.Errorf("failed to get CodeServer: %w", err)
+	}
+
+	patch, ok, err := legacyStatusPatch(obj)
+	if err != nil {
+		return fmt.Errorf("failed to create status patch: %w", err)
+	}
+	if !ok {
+		return nil
+	}
+
+	if err := c.Status().Patch(ctx, codeServer, client.RawPatch(types.MergePatchType, patch)); err != nil {
+		return fmt.Errorf("failed to migrate legacy status: %w", err)
+	}
+
+	logger.Info("Legacy status has been migrated.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+
+	return nil
+}
+
+// legacyStatusPatch returns the merge patch replacing the legacy status of the stored CodeServer with an object,
+// and false if the status is not the legacy one.
+func legacyStatusPatch(obj *unstructured.Unstructured) ([]byte, bool, error) {
+	phase, ok := obj.Object["status"].(string)
+	if !ok {
+		return nil, false, nil
+	}
+	patch, err := json.Marshal(map[string]any{
+		"status": csv1alpha2.CodeServerStatus{Phase: csv1alpha2.CodeServerPhase(phase)},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return patch, true, nil
+}
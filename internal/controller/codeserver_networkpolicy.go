@@ -0,0 +1,180 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	metav1apply "k8s.io/client-go/applyconfigurations/meta/v1"
+	networkingv1apply "k8s.io/client-go/applyconfigurations/networking/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+//+kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+
+// namespaceNameLabel is the label set to every namespace with its name.
+const namespaceNameLabel = "kubernetes.io/metadata.name"
+
+// reconcileNetworkPolicy creates the NetworkPolicy of code server pod if NetworkPolicy is specified,
+// and deletes the stale NetworkPolicy otherwise.
+func (r *CodeServerReconciler) reconcileNetworkPolicy(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	if codeServer.Spec.NetworkPolicy == nil {
+		policy := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: codeServer.Name, Namespace: codeServer.Namespace}}
+		if err := r.deleteOwned(ctx, codeServer, policy); err != nil {
+			return fmt.Errorf("failed to delete network policy: %w", err)
+		}
+		return nil
+	}
+
+	owner, err := controllerReference(codeServer, r.Scheme)
+	if err != nil {
+		return fmt.Errorf("failed to create controller reference: %w", err)
+	}
+
+	policy := networkingv1apply.NetworkPolicy(codeServer.Name, codeServer.Namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/name":       CodeServer,
+			"app.kubernetes.io/instance":   codeServer.Name,
+			"app.kubernetes.io/created-by": CodeServerManager,
+		}).
+		WithLabels(ownerLabels(codeServer)).
+		WithOwnerReferences(owner).
+		WithSpec(networkPolicySpec(codeServer, r.OperatorNamespace))
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(policy)
+	if err != nil {
+		return fmt.Errorf("failed to convert network policy to unstructured: %w", err)
+	}
+
+	patch := &unstructured.Unstructured{
+		Object: obj,
+	}
+
+	var current networkingv1.NetworkPolicy
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: codeServer.Namespace, Name: codeServer.Name}, &current)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get network policy: %w", err)
+	}
+
+	currentApplyConfig, err := networkingv1apply.ExtractNetworkPolicy(&current, CodeServerManager)
+	if err != nil {
+		return fmt.Errorf("failed to extract apply configuration from network policy: %w", err)
+	}
+
+	if equality.Semantic.DeepEqual(policy, currentApplyConfig) {
+		return nil
+	}
+
+	if err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
+		return fmt.Errorf("failed to apply network policy: %w", err)
+	}
+
+	logger.Info("NetworkPolicy has been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+	if current.CreationTimestamp.IsZero() {
+		r.recordCreated(&codeServer, "NetworkPolicy", codeServer.Name)
+	}
+
+	return nil
+}
+
+// networkPolicySpec returns the spec of the NetworkPolicy selecting code server pod.
+// The operator in operatorNamespace is allowed to connect if PortDiscovery is enabled.
+func networkPolicySpec(codeServer csv1alpha2.CodeServer, operatorNamespace string) *networkingv1apply.NetworkPolicySpecApplyConfiguration {
+	policy := codeServer.Spec.NetworkPolicy
+
+	from := []*networkingv1apply.NetworkPolicyPeerApplyConfiguration{
+		networkingv1apply.NetworkPolicyPeer().
+			WithNamespaceSelector(metav1apply.LabelSelector().
+				WithMatchLabels(map[string]string{namespaceNameLabel: policy.IngressControllerNamespace}),
+			),
+	}
+	if activator := policy.Activator; activator != nil {
+		peer := networkingv1apply.NetworkPolicyPeer().
+			WithNamespaceSelector(metav1apply.LabelSelector().
+				WithMatchLabels(map[string]string{namespaceNameLabel: activator.Namespace}),
+			)
+		if len(activator.PodSelector) > 0 {
+			peer.WithPodSelector(metav1apply.LabelSelector().
+				WithMatchLabels(activator.PodSelector),
+			)
+		}
+		from = append(from, peer)
+	}
+	if codeServer.Spec.PortDiscovery != nil && operatorNamespace != "" {
+		from = append(from, networkingv1apply.NetworkPolicyPeer().
+			WithNamespaceSelector(metav1apply.LabelSelector().
+				WithMatchLabels(map[string]string{namespaceNameLabel: operatorNamespace}),
+			).
+			WithPodSelector(metav1apply.LabelSelector().
+				WithMatchLabels(map[string]string{"control-plane": "controller-manager"}),
+			),
+		)
+	}
+
+	spec := networkingv1apply.NetworkPolicySpec().
+		WithPodSelector(metav1apply.LabelSelector().
+			WithMatchLabels(map[string]string{
+				"app.kubernetes.io/name":       CodeServer,
+				"app.kubernetes.io/instance":   codeServer.Name,
+				"app.kubernetes.io/created-by": CodeServerManager,
+			}),
+		).
+		WithIngress(networkingv1apply.NetworkPolicyIngressRule().
+			WithFrom(from...),
+		)
+
+	switch policy.Egress {
+	case csv1alpha2.EgressPolicyAllowlist:
+		spec.WithPolicyTypes(networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress)
+		spec.WithEgress(networkingv1apply.NetworkPolicyEgressRule().
+			WithPorts(
+				networkingv1apply.NetworkPolicyPort().WithProtocol(corev1.ProtocolUDP).WithPort(intstr.FromInt32(53)),
+				networkingv1apply.NetworkPolicyPort().WithProtocol(corev1.ProtocolTCP).WithPort(intstr.FromInt32(53)),
+			),
+		)
+		if len(policy.EgressCIDRs) > 0 {
+			to := make([]*networkingv1apply.NetworkPolicyPeerApplyConfiguration, 0, len(policy.EgressCIDRs))
+			for _, cidr := range policy.EgressCIDRs {
+				to = append(to, networkingv1apply.NetworkPolicyPeer().
+					WithIPBlock(networkingv1apply.IPBlock().WithCIDR(cidr)),
+				)
+			}
+			spec.WithEgress(networkingv1apply.NetworkPolicyEgressRule().WithTo(to...))
+		}
+	case csv1alpha2.EgressPolicyNone:
+		// Egress without any rule denies all traffic.
+		spec.WithPolicyTypes(networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress)
+	default:
+		spec.WithPolicyTypes(networkingv1.PolicyTypeIngress)
+	}
+
+	return spec
+}
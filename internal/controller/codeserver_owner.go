@@ -0,0 +1,287 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	rbacv1apply "k8s.io/client-go/applyconfigurations/rbac/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
+
+const (
+	// OwnerLabel is the label of the CodeServer and its resources with the name of the owner.
+	// The name is converted into a valid label value, e.g. "alice@example.com" into "alice_example.com".
+	OwnerLabel = "cs.walnuts.dev/owner"
+	// OwnerKindLabel is the label of the CodeServer and its resources with the kind of the owner.
+	OwnerKindLabel = "cs.walnuts.dev/owner-kind"
+)
+
+// ownerKind returns the kind of the owner of code server, which defaults in User.
+func ownerKind(owner csv1alpha2.CodeServerOwner) csv1alpha2.OwnerKind {
+	if owner.Kind == "" {
+		return csv1alpha2.OwnerKindUser
+	}
+	return owner.Kind
+}
+
+// ownerRoleName returns the name of the Role and RoleBinding of the owner of code server.
+func ownerRoleName(codeServer csv1alpha2.CodeServer) string {
+	return codeServer.Name + "-owner"
+}
+
+// ownerLabels returns the labels identifying the owner of code server, or nil if it has no owner.
+func ownerLabels(codeServer csv1alpha2.CodeServer) map[string]string {
+	owner := codeServer.Spec.Owner
+	if owner == nil {
+		return nil
+	}
+	return map[string]string{
+		OwnerLabel:     ownerLabelValue(owner.Name),
+		OwnerKindLabel: string(ownerKind(*owner)),
+	}
+}
+
+// ownerLabelValue converts the name of an owner into a label value.
+// The characters not allowed in a label value are replaced with "_",
+// and a long name is truncated with the hash of the name to keep it distinct.
+func ownerLabelValue(name string) string {
+	value := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+
+	if len(value) > 63 {
+		sum := sha256.Sum256([]byte(name))
+		value = value[:54] + "-" + hex.EncodeToString(sum[:])[:8]
+	}
+
+	// A label value must begin and end with an alphanumeric character.
+	return strings.TrimFunc(value, func(r rune) bool {
+		return r == '-' || r == '_' || r == '.'
+	})
+}
+
+// reconcileOwnerLabels sets the labels of the owner to the CodeServer, so that it can be selected by its owner.
+func (r *CodeServerReconciler) reconcileOwnerLabels(ctx context.Context, codeServer *csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	patch := client.MergeFrom(codeServer.DeepCopy())
+	labels := ownerLabels(*codeServer)
+
+	changed := false
+	for _, key := range []string{OwnerLabel, OwnerKindLabel} {
+		value, ok := labels[key]
+		current, exists := codeServer.Labels[key]
+		switch {
+		case !ok && exists:
+			delete(codeServer.Labels, key)
+			changed = true
+		case ok && (!exists || current != value):
+			if codeServer.Labels == nil {
+				codeServer.Labels = make(map[string]string)
+			}
+			codeServer.Labels[key] = value
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := r.Patch(ctx, codeServer, patch); err != nil {
+		return fmt.Errorf("failed to update owner labels: %w", err)
+	}
+
+	logger.Info("Owner labels have been reconciled.", "name", codeServer.Name, "namespace", codeServer.Namespace)
+
+	return nil
+}
+
+// reconcileOwnerRBAC creates the Role and RoleBinding granting the owner to get the CodeServer
+// and the secret of its password if Owner is specified, and deletes the stale ones otherwise.
+func (r *CodeServerReconciler) reconcileOwnerRBAC(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+	if codeServer.Spec.Owner == nil {
+		meta := metav1.ObjectMeta{Name: ownerRoleName(codeServer), Namespace: codeServer.Namespace}
+		if err := r.deleteOwned(ctx, codeServer, &rbacv1.RoleBinding{ObjectMeta: meta}); err != nil {
+			return fmt.Errorf("failed to delete owner role binding: %w", err)
+		}
+		if err := r.deleteOwned(ctx, codeServer, &rbacv1.Role{ObjectMeta: meta}); err != nil {
+			return fmt.Errorf("failed to delete owner role: %w", err)
+		}
+		return nil
+	}
+
+	if err := r.reconcileOwnerRole(ctx, codeServer); err != nil {
+		return err
+	}
+	return r.reconcileOwnerRoleBinding(ctx, codeServer)
+}
+
+// ownerRoleRules returns the rules granted to the owner, which are read-only.
+// Patch is not granted, since the owner could change any field of the spec, e.g. the image and the volumes, with it.
+// A secret specified with Password.SecretName is checked by the webhook to be readable by the user applying the owner.
+func ownerRoleRules(codeServer csv1alpha2.CodeServer) []*rbacv1apply.PolicyRuleApplyConfiguration {
+	return []*rbacv1apply.PolicyRuleApplyConfiguration{
+		rbacv1apply.PolicyRule().
+			WithAPIGroups(csv1alpha2.GroupVersion.Group).
+			WithResources("codeservers").
+			WithResourceNames(codeServer.Name).
+			WithVerbs("get"),
+		rbacv1apply.PolicyRule().
+			WithAPIGroups("").
+			WithResources("secrets").
+			WithResourceNames(codeServer.PasswordSecretName()).
+			WithVerbs("get"),
+	}
+}
+
+func (r *CodeServerReconciler) reconcileOwnerRole(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	owner, err := controllerReference(codeServer, r.Scheme)
+	if err != nil {
+		return fmt.Errorf("failed to create controller reference: %w", err)
+	}
+
+	name := ownerRoleName(codeServer)
+	role := rbacv1apply.Role(name, codeServer.Namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/name":       CodeServer,
+			"app.kubernetes.io/instance":   codeServer.Name,
+			"app.kubernetes.io/created-by": CodeServerManager,
+		}).
+		WithLabels(ownerLabels(codeServer)).
+		WithOwnerReferences(owner).
+		WithRules(ownerRoleRules(codeServer)...)
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(role)
+	if err != nil {
+		return fmt.Errorf("failed to convert owner role to unstructured: %w", err)
+	}
+
+	patch := &unstructured.Unstructured{
+		Object: obj,
+	}
+
+	var current rbacv1.Role
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: codeServer.Namespace, Name: name}, &current)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get owner role: %w", err)
+	}
+
+	currentApplyConfig, err := rbacv1apply.ExtractRole(&current, CodeServerManager)
+	if err != nil {
+		return fmt.Errorf("failed to extract apply configuration from owner role: %w", err)
+	}
+
+	if equality.Semantic.DeepEqual(role, currentApplyConfig) {
+		return nil
+	}
+
+	if err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
+		return fmt.Errorf("failed to apply owner role: %w", err)
+	}
+
+	logger.Info("Role has been reconciled.", "name", name, "namespace", codeServer.Namespace)
+	if current.CreationTimestamp.IsZero() {
+		r.recordCreated(&codeServer, "Role", name)
+	}
+
+	return nil
+}
+
+func (r *CodeServerReconciler) reconcileOwnerRoleBinding(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	owner, err := controllerReference(codeServer, r.Scheme)
+	if err != nil {
+		return fmt.Errorf("failed to create controller reference: %w", err)
+	}
+
+	name := ownerRoleName(codeServer)
+	binding := rbacv1apply.RoleBinding(name, codeServer.Namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/name":       CodeServer,
+			"app.kubernetes.io/instance":   codeServer.Name,
+			"app.kubernetes.io/created-by": CodeServerManager,
+		}).
+		WithLabels(ownerLabels(codeServer)).
+		WithOwnerReferences(owner).
+		WithSubjects(rbacv1apply.Subject().
+			WithKind(string(ownerKind(*codeServer.Spec.Owner))).
+			WithAPIGroup(rbacv1.GroupName).
+			WithName(codeServer.Spec.Owner.Name),
+		).
+		WithRoleRef(rbacv1apply.RoleRef().
+			WithAPIGroup(rbacv1.GroupName).
+			WithKind("Role").
+			WithName(name),
+		)
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(binding)
+	if err != nil {
+		return fmt.Errorf("failed to convert owner role binding to unstructured: %w", err)
+	}
+
+	patch := &unstructured.Unstructured{
+		Object: obj,
+	}
+
+	var current rbacv1.RoleBinding
+	err = r.Client.Get(ctx, client.ObjectKey{Namespace: codeServer.Namespace, Name: name}, &current)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to get owner role binding: %w", err)
+	}
+
+	currentApplyConfig, err := rbacv1apply.ExtractRoleBinding(&current, CodeServerManager)
+	if err != nil {
+		return fmt.Errorf("failed to extract apply configuration from owner role binding: %w", err)
+	}
+
+	if equality.Semantic.DeepEqual(binding, currentApplyConfig) {
+		return nil
+	}
+
+	if err = r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
+		return fmt.Errorf("failed to apply owner role binding: %w", err)
+	}
+
+	logger.Info("RoleBinding has been reconciled.", "name", name, "namespace", codeServer.Namespace)
+	if current.CreationTimestamp.IsZero() {
+		r.recordCreated(&codeServer, "RoleBinding", name)
+	}
+
+	return nil
+}
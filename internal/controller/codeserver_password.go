@@ -0,0 +1,162 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// PasswordKey is the key of the secret of the CodeServer holding the generated password.
+	PasswordKey = "password"
+	// HashedPasswordKey is the key of the secret of the CodeServer holding the argon2id hash of the password.
+	HashedPasswordKey = "hashed-password"
+	// PasswordSaltKey is the key of the secret of the CodeServer holding the random key the version of the password
+	// in an existing secret is derived with, so that the version does not reveal the password.
+	PasswordSaltKey = "password-salt"
+
+	// RotatePasswordAnnotation is the annotation of the CodeServer requesting to rotate the generated password.
+	// It is removed once the password is rotated.
+	RotatePasswordAnnotation = "cs.walnuts.dev/rotate-password"
+	// PasswordVersionAnnotation is the annotation of the secret of the CodeServer and code server pod
+	// identifying the password, so that code server pod is restarted when it is changed.
+	PasswordVersionAnnotation = "cs.walnuts.dev/password-version"
+	// PasswordRotatedAtAnnotation is the annotation of the secret of the CodeServer with the last time the password was rotated.
+	PasswordRotatedAtAnnotation = "cs.walnuts.dev/password-rotated-at"
+)
+
+// passwordVersion returns the version of the password in an existing secret, which changes only with the password.
+func passwordVersion(password []byte, salt []byte) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(password)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// passwordKey returns the key of the password in the secret of the password.
+func passwordKey(codeServer csv1alpha2.CodeServer) string {
+	if codeServer.Spec.Password != nil && codeServer.Spec.Password.SecretName != "" && codeServer.Spec.Password.Key != "" {
+		return codeServer.Spec.Password.Key
+	}
+	return PasswordKey
+}
+
+// passwordEnv returns the env passing the password to code server, which is HASHED_PASSWORD if Hashed is specified.
+func passwordEnv(codeServer csv1alpha2.CodeServer) *corev1apply.EnvVarApplyConfiguration {
+	name, secretName, key := "PASSWORD", codeServer.PasswordSecretName(), passwordKey(codeServer)
+	if codeServer.Spec.Password != nil && codeServer.Spec.Password.Hashed {
+		name, secretName, key = "HASHED_PASSWORD", codeServer.Name, HashedPasswordKey
+	}
+
+	return corev1apply.EnvVar().
+		WithName(name).
+		WithValueFrom(corev1apply.EnvVarSource().
+			WithSecretKeyRef(corev1apply.SecretKeySelector().
+				WithName(secretName).
+				WithKey(key),
+			),
+		)
+}
+
+// lastPasswordRotation returns the last time the generated password was rotated, or the secret was created.
+func lastPasswordRotation(secret corev1.Secret) time.Time {
+	if rotatedAt, err := time.Parse(time.RFC3339, secret.Annotations[PasswordRotatedAtAnnotation]); err == nil {
+		return rotatedAt
+	}
+	return secret.CreationTimestamp.Time
+}
+
+// passwordRotationDue reports whether the generated password in secret should be rotated at now.
+func passwordRotationDue(codeServer csv1alpha2.CodeServer, secret corev1.Secret, now time.Time) bool {
+	if _, ok := codeServer.Annotations[RotatePasswordAnnotation]; ok {
+		return true
+	}
+	if codeServer.Spec.Password == nil || codeServer.Spec.Password.RotationIntervalSeconds == nil || secret.CreationTimestamp.IsZero() {
+		return false
+	}
+	interval := time.Duration(*codeServer.Spec.Password.RotationIntervalSeconds) * time.Second
+	return !now.Before(lastPasswordRotation(secret).Add(interval))
+}
+
+// nextPasswordRotation returns the time to wait before rotating the generated password in secret, or zero if it is not rotated periodically.
+func nextPasswordRotation(codeServer csv1alpha2.CodeServer, secret corev1.Secret, now time.Time) time.Duration {
+	if codeServer.Spec.Password == nil || codeServer.Spec.Password.RotationIntervalSeconds == nil || codeServer.Spec.Password.SecretName != "" {
+		return 0
+	}
+	interval := time.Duration(*codeServer.Spec.Password.RotationIntervalSeconds) * time.Second
+	return max(lastPasswordRotation(secret).Add(interval).Sub(now), time.Second)
+}
+
+// removeRotatePasswordAnnotation removes the annotation requesting the rotation of the password from the CodeServer.
+func (r *CodeServerReconciler) removeRotatePasswordAnnotation(ctx context.Context, codeServer *csv1alpha2.CodeServer) error {
+	if _, ok := codeServer.Annotations[RotatePasswordAnnotation]; !ok {
+		return nil
+	}
+
+	patch := client.MergeFrom(codeServer.DeepCopy())
+	delete(codeServer.Annotations, RotatePasswordAnnotation)
+	if err := r.Patch(ctx, codeServer, patch); err != nil {
+		return fmt.Errorf("failed to remove rotate password annotation: %w", err)
+	}
+	return nil
+}
+
+// observePasswordRotation returns the last time the password was rotated, recorded in the secret of the CodeServer.
+func (r *CodeServerReconciler) observePasswordRotation(ctx context.Context, codeServer csv1alpha2.CodeServer) (*metav1.Time, error) {
+	var secret corev1.Secret
+	if err := r.Get(ctx, client.ObjectKey{Name: codeServer.Name, Namespace: codeServer.Namespace}, &secret); err != nil {
+		return nil, fmt.Errorf("failed to get secret: %w", err)
+	}
+
+	rotatedAt, err := time.Parse(time.RFC3339, secret.Annotations[PasswordRotatedAtAnnotation])
+	if err != nil {
+		return nil, nil
+	}
+	return &metav1.Time{Time: rotatedAt}, nil
+}
+
+// codeServersForSecret returns the requests of the CodeServers using secret as the password,
+// so that code server pod is restarted when the password is changed.
+func (r *CodeServerReconciler) codeServersForSecret(ctx context.Context, secret client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	var codeServers csv1alpha2.CodeServerList
+	if err := r.List(ctx, &codeServers, client.InNamespace(secret.GetNamespace())); err != nil {
+		logger.Error(err, "Failed to list CodeServers.", "namespace", secret.GetNamespace())
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, codeServer := range codeServers.Items {
+		if codeServer.Spec.Password != nil && codeServer.Spec.Password.SecretName == secret.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&codeServer)})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// minNotReadyRequeue is the first interval to requeue code server while its pod is not ready.
+	minNotReadyRequeue = 5 * time.Second
+	// maxNotReadyRequeue caps the interval to requeue code server while its pod is not ready.
+	// Changes of the pods are watched, so requeueing only catches what is not reported by them.
+	maxNotReadyRequeue = 5 * time.Minute
+)
+
+// notReadyRequeueAfter returns the interval to requeue code server which has not been ready for elapsed.
+// The interval grows with elapsed, so that a pod failing for a long time is not checked in a hot loop.
+func notReadyRequeueAfter(elapsed time.Duration) time.Duration {
+	return min(max(elapsed/2, minNotReadyRequeue), maxNotReadyRequeue)
+}
+
+// observePods returns the PodHealthy condition of code server, telling the failure of the pods if any.
+// The newest pod is inspected first, since it is the one being rolled out.
+func observePods(codeServer csv1alpha2.CodeServer, pods []corev1.Pod, pvc corev1.PersistentVolumeClaim) metav1.Condition {
+	condition := metav1.Condition{
+		Type:               csv1alpha2.ConditionTypePodHealthy,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: codeServer.Generation,
+	}
+
+	pods = slices.Clone(pods)
+	slices.SortStableFunc(pods, func(a, b corev1.Pod) int {
+		return b.CreationTimestamp.Compare(a.CreationTimestamp.Time)
+	})
+	for _, pod := range pods {
+		if !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if reason, message := podFailure(pod, pvc); reason != "" {
+			condition.Reason = reason
+			condition.Message = message
+			return condition
+		}
+	}
+
+	condition.Status = metav1.ConditionTrue
+	condition.Reason = "Healthy"
+	condition.Message = "no failure is found in code server pod"
+	return condition
+}
+
+// podFailure returns the reason and message of the failure of the pod, or empty strings if it is not failing.
+func podFailure(pod corev1.Pod, pvc corev1.PersistentVolumeClaim) (string, string) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type != corev1.PodScheduled || condition.Status != corev1.ConditionFalse || condition.Reason != corev1.PodReasonUnschedulable {
+			continue
+		}
+		// An unbound claim keeps the pod from being scheduled, which is the cause to be fixed.
+		if pvc.Name != "" && pvc.Status.Phase == corev1.ClaimPending {
+			return "PVCPending", fmt.Sprintf("persistent volume claim %s is pending: %s", pvc.Name, condition.Message)
+		}
+		return "Unschedulable", fmt.Sprintf("pod %s cannot be scheduled: %s", pod.Name, condition.Message)
+	}
+
+	for _, status := range pod.Status.InitContainerStatuses {
+		if reason, message := imagePullFailure(status); reason != "" {
+			return reason, message
+		}
+		if terminated := lastTermination(status); terminated != nil && terminated.ExitCode != 0 {
+			return "InitContainerFailed", fmt.Sprintf("init container %q exited with code %d", status.Name, terminated.ExitCode)
+		}
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		if reason, message := imagePullFailure(status); reason != "" {
+			return reason, message
+		}
+		if waiting := status.State.Waiting; waiting != nil && waiting.Reason == "CrashLoopBackOff" {
+			message := fmt.Sprintf("container %q is crashing", status.Name)
+			if terminated := status.LastTerminationState.Terminated; terminated != nil {
+				message = fmt.Sprintf("container %q is crashing: exited with code %d", status.Name, terminated.ExitCode)
+			}
+			return "CrashLoopBackOff", message
+		}
+	}
+
+	return "", ""
+}
+
+// imagePullFailure returns the reason and message if the image of the container cannot be pulled.
+func imagePullFailure(status corev1.ContainerStatus) (string, string) {
+	waiting := status.State.Waiting
+	if waiting == nil {
+		return "", ""
+	}
+	switch waiting.Reason {
+	case "ImagePullBackOff", "ErrImagePull", "InvalidImageName":
+		return "ImagePullBackOff", fmt.Sprintf("image %q of container %q cannot be pulled: %s", status.Image, status.Name, waiting.Message)
+	}
+	return "", ""
+}
+
+// lastTermination returns the termination of the container, or the last one while it is waiting to be restarted.
+func lastTermination(status corev1.ContainerStatus) *corev1.ContainerStateTerminated {
+	if status.State.Terminated != nil {
+		return status.State.Terminated
+	}
+	if status.State.Waiting != nil {
+		return status.LastTerminationState.Terminated
+	}
+	return nil
+}
+
+// codeServerForObject maps the pod or PVC of code server to the CodeServer by its labels,
+// e.g. to report the failures of the pod as soon as they happen.
+func codeServerForObject(_ context.Context, obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	if labels["app.kubernetes.io/name"] != CodeServer || labels["app.kubernetes.io/created-by"] != CodeServerManager {
+		return nil
+	}
+	name := labels["app.kubernetes.io/instance"]
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Namespace: obj.GetNamespace(), Name: name}}}
+}
@@ -0,0 +1,354 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	"github.com/walnuts1018/code-server-operator/internal/portscan"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const (
+	// portScanTimeout bounds the whole scan of code server pod.
+	portScanTimeout = 10 * time.Second
+	// portDialTimeout is the time to wait for a port to accept the connection.
+	portDialTimeout = 200 * time.Millisecond
+	// portScanWorkers is the number of pods scanned at the same time.
+	portScanWorkers = 4
+	// portScanTick is the interval to look for the pods due to be scanned.
+	portScanTick = time.Second
+)
+
+// reconcilePortDiscovery has the port scanner scan code server pod every interval in the background,
+// and records the listening ports found by the latest scan in the status only when they change.
+func (r *CodeServerReconciler) reconcilePortDiscovery(ctx context.Context, codeServer *csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+	key := client.ObjectKeyFromObject(codeServer)
+
+	discovery := codeServer.Spec.PortDiscovery
+	if discovery == nil {
+		if r.portScanner != nil {
+			r.portScanner.Forget(key)
+		}
+		if codeServer.Status.DiscoveredPorts == nil && codeServer.Status.PortsScannedAt == nil {
+			return nil
+		}
+		codeServer.Status.DiscoveredPorts = nil
+		codeServer.Status.PortsScannedAt = nil
+		if err := r.Status().Update(ctx, codeServer); err != nil {
+			return fmt.Errorf("failed to update discovered ports: %w", err)
+		}
+		return nil
+	}
+	if r.portScanner == nil {
+		return fmt.Errorf("port scanner is not set up with the manager")
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(codeServer.Namespace), client.MatchingLabels{
+		"app.kubernetes.io/name":       CodeServer,
+		"app.kubernetes.io/instance":   codeServer.Name,
+		"app.kubernetes.io/created-by": CodeServerManager,
+	}); err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+
+	var podIP string
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodRunning && pod.Status.PodIP != "" && pod.DeletionTimestamp.IsZero() {
+			podIP = pod.Status.PodIP
+			break
+		}
+	}
+
+	// Nothing is listening without a running pod.
+	var ports []int32
+	scannedAt := time.Now()
+	if podIP == "" {
+		r.portScanner.Forget(key)
+	} else {
+		r.portScanner.Watch(key, portScanTarget{
+			podIP:    podIP,
+			ports:    discoveryPorts(*codeServer),
+			interval: time.Duration(discovery.IntervalSeconds) * time.Second,
+		})
+		result, ok := r.portScanner.Result(key)
+		if !ok {
+			// The scanner enqueues the CodeServer once the pod has been scanned.
+			return nil
+		}
+		ports, scannedAt = result.ports, result.scannedAt
+	}
+
+	if slices.Equal(ports, codeServer.Status.DiscoveredPorts) {
+		return nil
+	}
+	codeServer.Status.DiscoveredPorts = ports
+	codeServer.Status.PortsScannedAt = &metav1.Time{Time: scannedAt}
+	if err := r.Status().Update(ctx, codeServer); err != nil {
+		return fmt.Errorf("failed to update discovered ports: %w", err)
+	}
+
+	logger.Info("Discovered ports have been updated.", "name", codeServer.Name, "namespace", codeServer.Namespace, "ports", ports)
+
+	return nil
+}
+
+// portScanTarget is the pod of a CodeServer to be scanned every interval.
+type portScanTarget struct {
+	podIP    string
+	ports    []int32
+	interval time.Duration
+}
+
+// portScanResult is the result of the latest finished scan of a pod.
+type portScanResult struct {
+	ports     []int32
+	scannedAt time.Time
+}
+
+type portScanState struct {
+	target   portScanTarget
+	nextScan time.Time
+	scanning bool
+	result   *portScanResult
+}
+
+// portScanner scans the pods of the CodeServers in the background, so that a scan lasting up to portScanTimeout
+// does not block a worker of the controller. The CodeServer is enqueued through events when its ports change.
+// A scan which does not finish in time is discarded, keeping the ports found by the previous scan.
+type portScanner struct {
+	// events notifies the controller of the CodeServers whose ports have changed.
+	events chan event.GenericEvent
+
+	mu     sync.Mutex
+	states map[types.NamespacedName]*portScanState
+}
+
+var _ manager.Runnable = &portScanner{}
+
+func newPortScanner() *portScanner {
+	return &portScanner{
+		events: make(chan event.GenericEvent),
+		states: make(map[types.NamespacedName]*portScanState),
+	}
+}
+
+// Watch has the scanner scan the target of the CodeServer every interval.
+// The target is scanned immediately if its pod or ports have changed.
+func (s *portScanner) Watch(key types.NamespacedName, target portScanTarget) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[key]
+	if !ok {
+		state = &portScanState{}
+		s.states[key] = state
+	}
+	if state.target.podIP != target.podIP || !slices.Equal(state.target.ports, target.ports) {
+		state.nextScan = time.Time{}
+		state.result = nil
+	}
+	state.target = target
+}
+
+// Forget stops scanning the CodeServer and drops its result.
+func (s *portScanner) Forget(key types.NamespacedName) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, key)
+}
+
+// Result returns the result of the latest finished scan of the current target of the CodeServer.
+func (s *portScanner) Result(key types.NamespacedName) (portScanResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[key]
+	if !ok || state.result == nil {
+		return portScanResult{}, false
+	}
+	return *state.result, true
+}
+
+// Start scans the targets due until ctx is done.
+func (s *portScanner) Start(ctx context.Context) error {
+	requests := make(chan types.NamespacedName)
+	var wg sync.WaitGroup
+	for range portScanWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case key := <-requests:
+					s.scan(ctx, key)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+
+	ticker := time.NewTicker(portScanTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			for _, key := range s.due(now) {
+				select {
+				case <-ctx.Done():
+					return nil
+				case requests <- key:
+				}
+			}
+		}
+	}
+}
+
+// due returns the CodeServers to be scanned at now, marking them as being scanned.
+func (s *portScanner) due(now time.Time) []types.NamespacedName {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []types.NamespacedName
+	for key, state := range s.states {
+		if state.scanning || now.Before(state.nextScan) {
+			continue
+		}
+		state.scanning = true
+		state.nextScan = now.Add(state.target.interval)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// scan scans the target of the CodeServer, and enqueues the CodeServer if the ports have changed.
+func (s *portScanner) scan(ctx context.Context, key types.NamespacedName) {
+	logger := log.FromContext(ctx)
+
+	s.mu.Lock()
+	state, ok := s.states[key]
+	var target portScanTarget
+	if ok {
+		target = state.target
+	}
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	scanCtx, cancel := context.WithTimeout(ctx, portScanTimeout)
+	ports, err := portscan.Scan(scanCtx, target.podIP, target.ports, portDialTimeout)
+	cancel()
+
+	s.mu.Lock()
+	// The state is replaced if the CodeServer has been forgotten and watched again during the scan.
+	if s.states[key] != state {
+		s.mu.Unlock()
+		return
+	}
+	state.scanning = false
+	changed := false
+	// The result of a scan is stale if the target has changed during the scan.
+	if err == nil && state.target.podIP == target.podIP && slices.Equal(state.target.ports, target.ports) {
+		changed = state.result == nil || !slices.Equal(state.result.ports, ports)
+		state.result = &portScanResult{ports: ports, scannedAt: time.Now()}
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Info("Port scan did not finish in time, keeping the discovered ports.", "name", key.Name, "namespace", key.Namespace, "error", err.Error())
+		}
+		return
+	}
+	if !changed {
+		return
+	}
+
+	codeServer := &csv1alpha2.CodeServer{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	select {
+	case <-ctx.Done():
+	case s.events <- event.GenericEvent{Object: codeServer}:
+	}
+}
+
+// discoveryPorts returns the ports to scan for PortDiscovery.
+func discoveryPorts(codeServer csv1alpha2.CodeServer) []int32 {
+	discovery := codeServer.Spec.PortDiscovery
+	if discovery == nil {
+		return nil
+	}
+
+	allow := toPortscanRanges(discovery.Allow)
+	if len(allow) == 0 {
+		allow = []portscan.Range{{Start: 3000, End: 8999}}
+	}
+	deny := append(toPortscanRanges(discovery.Deny),
+		portscan.Range{Start: codeServer.Spec.ContainerPort, End: codeServer.Spec.ContainerPort},
+		portscan.Range{Start: servicePort(codeServer), End: servicePort(codeServer)},
+	)
+	for _, sidecar := range codeServer.Spec.Sidecars {
+		for _, port := range sidecar.Ports {
+			deny = append(deny, portscan.Range{Start: port.ContainerPort, End: port.ContainerPort})
+		}
+	}
+	return portscan.Ports(allow, deny)
+}
+
+func toPortscanRanges(ranges []csv1alpha2.PortRange) []portscan.Range {
+	result := make([]portscan.Range, 0, len(ranges))
+	for _, r := range ranges {
+		end := r.End
+		if end == 0 {
+			end = r.Start
+		}
+		result = append(result, portscan.Range{Start: r.Start, End: end})
+	}
+	return result
+}
+
+// proxyPorts returns PublicProxyPorts followed by the discovered ports which are not in PublicProxyPorts,
+// up to MaxProxyPorts so that HTTPRoute does not exceed its limits.
+func proxyPorts(codeServer csv1alpha2.CodeServer) []int32 {
+	ports := slices.Clone(codeServer.Spec.PublicProxyPorts)
+	for _, port := range codeServer.Status.DiscoveredPorts {
+		if len(ports) >= csv1alpha2.MaxProxyPorts {
+			break
+		}
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
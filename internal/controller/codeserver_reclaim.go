@@ -0,0 +1,343 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	batchv1apply "k8s.io/client-go/applyconfigurations/batch/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ReclaimFinalizer is the finalizer of CodeServers whose persistent volume claim is retained or archived on deletion.
+const ReclaimFinalizer = "cs.walnuts.dev/reclaim"
+
+const (
+	// RetainedFromLabel is the label of a retained PVC that records the name of the deleted CodeServer.
+	RetainedFromLabel = "cs.walnuts.dev/retained-from"
+	// RetainedAtAnnotationKey is the annotation of a retained PVC that records when the CodeServer was deleted.
+	RetainedAtAnnotationKey = "cs.walnuts.dev/retained-at"
+)
+
+// podTerminationPollInterval is the interval to wait for code server pod to terminate before archiving the home directory.
+const podTerminationPollInterval = 5 * time.Second
+
+// reclaimsPVC reports whether the PVC of code server is retained or archived on deletion.
+// An existing claim is never deleted with the CodeServer, so it is not reclaimed.
+func reclaimsPVC(codeServer csv1alpha2.CodeServer) bool {
+	return codeServer.Spec.ExistingClaim == "" &&
+		(codeServer.Spec.ReclaimPolicy == csv1alpha2.ReclaimPolicyRetain || codeServer.Spec.ReclaimPolicy == csv1alpha2.ReclaimPolicyArchive)
+}
+
+// removeOwnerReference removes the owner reference of the owner with uid from obj.
+func removeOwnerReference(obj metav1.Object, uid types.UID) {
+	ownerReferences := make([]metav1.OwnerReference, 0, len(obj.GetOwnerReferences()))
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != uid {
+			ownerReferences = append(ownerReferences, ref)
+		}
+	}
+	obj.SetOwnerReferences(ownerReferences)
+}
+
+// reconcileFinalizer adds the reclaim finalizer if the PVC is retained or archived, and removes it otherwise.
+func (r *CodeServerReconciler) reconcileFinalizer(ctx context.Context, codeServer *csv1alpha2.CodeServer) error {
+	needsFinalizer := reclaimsPVC(*codeServer)
+	if needsFinalizer == controllerutil.ContainsFinalizer(codeServer, ReclaimFinalizer) {
+		return nil
+	}
+
+	if needsFinalizer {
+		controllerutil.AddFinalizer(codeServer, ReclaimFinalizer)
+	} else {
+		controllerutil.RemoveFinalizer(codeServer, ReclaimFinalizer)
+	}
+	if err := r.Update(ctx, codeServer); err != nil {
+		return fmt.Errorf("failed to update finalizer: %w", err)
+	}
+	return nil
+}
+
+// finalize retains or archives the persistent volume claim of the deleted CodeServer before removing the reclaim finalizer.
+func (r *CodeServerReconciler) finalize(ctx context.Context, codeServer csv1alpha2.CodeServer) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(&codeServer, ReclaimFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	switch codeServer.Spec.ReclaimPolicy {
+	case csv1alpha2.ReclaimPolicyRetain:
+		if err := r.retainPVC(ctx, codeServer); err != nil {
+			return ctrl.Result{}, err
+		}
+	case csv1alpha2.ReclaimPolicyArchive:
+		archiving, requeueAfter, err := r.reconcileArchiveJob(ctx, codeServer)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if archiving != nil {
+			return ctrl.Result{RequeueAfter: requeueAfter}, r.updateNotReadyStatus(ctx, codeServer, *archiving)
+		}
+	}
+
+	controllerutil.RemoveFinalizer(&codeServer, ReclaimFinalizer)
+	if err := r.Update(ctx, &codeServer); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to remove finalizer: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// retainPVC labels the PVC with the deleted CodeServer and makes sure it has no owner reference of the CodeServer.
+// The owner reference is removed by reconcilePVC in advance, since the garbage collector may delete the PVC
+// before the finalizer runs with foreground cascading deletion.
+func (r *CodeServerReconciler) retainPVC(ctx context.Context, codeServer csv1alpha2.CodeServer) error {
+	logger := log.FromContext(ctx)
+
+	var pvc corev1.PersistentVolumeClaim
+	err := r.Get(ctx, client.ObjectKey{Name: codeServer.Name, Namespace: codeServer.Namespace}, &pvc)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get PVC: %w", err)
+	}
+
+	patch := client.MergeFrom(pvc.DeepCopy())
+	removeOwnerReference(&pvc, codeServer.UID)
+	if pvc.Labels == nil {
+		pvc.Labels = make(map[string]string)
+	}
+	pvc.Labels[RetainedFromLabel] = codeServer.Name
+	if pvc.Annotations == nil {
+		pvc.Annotations = make(map[string]string)
+	}
+	pvc.Annotations[RetainedAtAnnotationKey] = codeServer.DeletionTimestamp.UTC().Format(time.RFC3339)
+
+	if err := r.Patch(ctx, &pvc, patch); err != nil {
+		return fmt.Errorf("failed to retain PVC: %w", err)
+	}
+
+	logger.Info("PVC has been retained.", "name", pvc.Name, "namespace", pvc.Namespace)
+	return nil
+}
+
+// reconcileArchiveJob stops code server pod and runs a Job that uploads a tarball of the home directory.
+// Neither the PVC nor the Job is owned by the CodeServer, so that they are not garbage collected while archiving,
+// and both are deleted once the Job has completed.
+// It returns the Ready condition to report and the interval to check again while archiving, or nil once the Job has completed.
+func (r *CodeServerReconciler) reconcileArchiveJob(ctx context.Context, codeServer csv1alpha2.CodeServer) (*metav1.Condition, time.Duration, error) {
+	logger := log.FromContext(ctx)
+
+	var pvc corev1.PersistentVolumeClaim
+	err := r.Get(ctx, client.ObjectKey{Name: codeServer.Name, Namespace: codeServer.Namespace}, &pvc)
+	if errors.IsNotFound(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get PVC: %w", err)
+	}
+
+	key := archiveObjectKey(codeServer)
+	jobName := codeServer.Name + "-archive"
+	var job batchv1.Job
+	err = r.Get(ctx, client.ObjectKey{Name: jobName, Namespace: codeServer.Namespace}, &job)
+	switch {
+	case errors.IsNotFound(err):
+		// Stop code server first so that the archive is consistent.
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: codeServer.Name, Namespace: codeServer.Namespace}}
+		if err := r.Delete(ctx, deployment); client.IgnoreNotFound(err) != nil {
+			return nil, 0, fmt.Errorf("failed to delete deployment: %w", err)
+		}
+		var pods corev1.PodList
+		if err := r.List(ctx, &pods, client.InNamespace(codeServer.Namespace), client.MatchingLabels{
+			"app.kubernetes.io/name":       CodeServer,
+			"app.kubernetes.io/instance":   codeServer.Name,
+			"app.kubernetes.io/created-by": CodeServerManager,
+		}); err != nil {
+			return nil, 0, fmt.Errorf("failed to list pods: %w", err)
+		}
+		if len(pods.Items) > 0 {
+			return &metav1.Condition{
+				Reason:  "Archiving",
+				Message: "waiting for code server pod to terminate before archiving the home directory",
+			}, podTerminationPollInterval, nil
+		}
+
+		if err := r.createArchiveJob(ctx, codeServer, jobName, key); err != nil {
+			return nil, 0, err
+		}
+		logger.Info("Archive job has been created.", "name", jobName, "namespace", codeServer.Namespace, "bucket", codeServer.Spec.Archive.Bucket, "key", key)
+		r.recordCreated(&codeServer, "Job", jobName)
+	case err != nil:
+		return nil, 0, fmt.Errorf("failed to get archive job: %w", err)
+	case jobCondition(job, batchv1.JobFailed) != nil:
+		r.Recorder.Event(&codeServer, corev1.EventTypeWarning, "ArchiveFailed", "Failed to archive the home directory")
+		return &metav1.Condition{
+			Reason:  "ArchiveFailed",
+			Message: fmt.Sprintf("failed to archive the home directory, delete job %q to retry or remove finalizer %q to delete the CodeServer without archiving, leaving PVC %q", jobName, ReclaimFinalizer, pvc.Name),
+		}, 0, nil
+	case jobCondition(job, batchv1.JobComplete) != nil:
+		logger.Info("Home directory has been archived.", "name", codeServer.Name, "namespace", codeServer.Namespace, "bucket", codeServer.Spec.Archive.Bucket, "key", key)
+		r.Recorder.Eventf(&codeServer, corev1.EventTypeNormal, "Archived", "Archived the home directory to s3://%s/%s", codeServer.Spec.Archive.Bucket, key)
+		if err := r.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return nil, 0, fmt.Errorf("failed to delete archive job: %w", err)
+		}
+		if err := r.Delete(ctx, &pvc); client.IgnoreNotFound(err) != nil {
+			return nil, 0, fmt.Errorf("failed to delete PVC: %w", err)
+		}
+		return nil, 0, nil
+	}
+
+	return &metav1.Condition{
+		Reason:  "Archiving",
+		Message: fmt.Sprintf("archiving the home directory to s3://%s/%s", codeServer.Spec.Archive.Bucket, key),
+	}, 0, nil
+}
+
+func (r *CodeServerReconciler) createArchiveJob(ctx context.Context, codeServer csv1alpha2.CodeServer, name string, key string) error {
+	if codeServer.Spec.Archive == nil {
+		return fmt.Errorf("archive is required with the Archive reclaim policy")
+	}
+	archive := codeServer.Spec.Archive
+
+	podSecurityContext, containerSecurityContext, err := securityContexts(codeServer.Spec.SecurityContext)
+	if err != nil {
+		return err
+	}
+
+	envs := []*corev1apply.EnvVarApplyConfiguration{
+		corev1apply.EnvVar().WithName("HOME").WithValue("/tmp"),
+		corev1apply.EnvVar().WithName("AWS_DEFAULT_REGION").WithValue(archive.Region),
+		corev1apply.EnvVar().WithName("ARCHIVE_URL").WithValue(fmt.Sprintf("s3://%s/%s", archive.Bucket, key)),
+	}
+	if archive.Endpoint != "" {
+		envs = append(envs, corev1apply.EnvVar().WithName("AWS_ENDPOINT_URL").WithValue(archive.Endpoint))
+	}
+
+	// The home directory is archived with the image of code server, which has tar and gzip,
+	// so that the image of the AWS CLI only has to upload the archive.
+	archiveContainer := corev1apply.Container().
+		WithName("archive").
+		WithImage(codeServer.Spec.Image).
+		WithCommand("tar", "-czf", "/archive/home.tar.gz", "-C", "/home/coder", ".").
+		WithVolumeMounts(
+			corev1apply.VolumeMount().
+				WithName("home").
+				WithMountPath("/home/coder").
+				WithReadOnly(true),
+			corev1apply.VolumeMount().
+				WithName("archive").
+				WithMountPath("/archive"),
+		)
+	uploadContainer := corev1apply.Container().
+		WithName("upload").
+		WithImage(archive.Image).
+		WithCommand("aws", "s3", "cp", "/archive/home.tar.gz", "$(ARCHIVE_URL)").
+		WithEnv(envs...).
+		WithEnvFrom(corev1apply.EnvFromSource().
+			WithSecretRef(corev1apply.SecretEnvSource().
+				WithName(archive.CredentialsSecretName),
+			),
+		).
+		WithVolumeMounts(corev1apply.VolumeMount().
+			WithName("archive").
+			WithMountPath("/archive").
+			WithReadOnly(true),
+		)
+	if containerSecurityContext != nil {
+		archiveContainer.WithSecurityContext(containerSecurityContext)
+		uploadContainer.WithSecurityContext(containerSecurityContext)
+	}
+
+	podSpec := corev1apply.PodSpec().
+		WithRestartPolicy(corev1.RestartPolicyNever).
+		WithInitContainers(archiveContainer).
+		WithContainers(uploadContainer).
+		WithVolumes(
+			corev1apply.Volume().
+				WithName("home").
+				WithPersistentVolumeClaim(corev1apply.PersistentVolumeClaimVolumeSource().
+					WithClaimName(codeServer.Name).
+					WithReadOnly(true),
+				),
+			corev1apply.Volume().
+				WithName("archive").
+				WithEmptyDir(corev1apply.EmptyDirVolumeSource()),
+		)
+	if podSecurityContext != nil {
+		podSpec.WithSecurityContext(podSecurityContext)
+	}
+	if err := applyScheduling(podSpec, codeServer.Spec); err != nil {
+		return err
+	}
+
+	labels := map[string]string{
+		"app.kubernetes.io/name":       CodeServer,
+		"app.kubernetes.io/instance":   codeServer.Name,
+		"app.kubernetes.io/created-by": CodeServerManager,
+	}
+	job := batchv1apply.Job(name, codeServer.Namespace).
+		WithLabels(labels).
+		WithSpec(batchv1apply.JobSpec().
+			WithBackoffLimit(3).
+			WithTemplate(corev1apply.PodTemplateSpec().
+				WithLabels(map[string]string{
+					"app.kubernetes.io/name":       CodeServer + "-archive",
+					"app.kubernetes.io/instance":   codeServer.Name,
+					"app.kubernetes.io/created-by": CodeServerManager,
+				}).
+				WithSpec(podSpec),
+			),
+		)
+
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(job)
+	if err != nil {
+		return fmt.Errorf("failed to convert archive job to unstructured: %w", err)
+	}
+	patch := &unstructured.Unstructured{
+		Object: obj,
+	}
+	if err := r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
+		return fmt.Errorf("failed to apply archive job: %w", err)
+	}
+	return nil
+}
+
+// archiveObjectKey returns the object key of the archive, which is stable while the CodeServer is being deleted.
+func archiveObjectKey(codeServer csv1alpha2.CodeServer) string {
+	prefix := ""
+	if codeServer.Spec.Archive != nil {
+		prefix = codeServer.Spec.Archive.Prefix
+	}
+	deletedAt := ptr.Deref(codeServer.DeletionTimestamp, metav1.Time{}).UTC().Format("20060102T150405Z")
+	return fmt.Sprintf("%s%s/%s/%s.tar.gz", prefix, codeServer.Namespace, codeServer.Name, deletedAt)
+}
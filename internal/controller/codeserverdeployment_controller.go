@@ -20,14 +20,17 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"slices"
 
 	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
 	"github.com/walnuts1018/code-server-operator/util/random"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -39,6 +42,9 @@ import (
 type CodeServerDeploymentReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// Recorder records the events of the CodeServerDeployments.
+	Recorder record.EventRecorder
 }
 
 //+kubebuilder:rbac:groups=cs.walnuts.dev,resources=codeserverdeployments,verbs=get;list;watch;create;update;patch;delete
@@ -103,9 +109,24 @@ func (r *CodeServerDeploymentReconciler) reconcileCodeServer(ctx context.Context
 		return fmt.Errorf("failed to list CodeServer: %w", err)
 	}
 
+	// 一度割り当てたOwnerは変更せず、Ownersから外れたOwnerのCodeServerは削除する
+	plan := planReplicas(codeServers.Items, codeServerDeployments.Spec.Template.Spec.Owner, codeServerDeployments.Spec.Owners, codeServerDeployments.Spec.Replicas)
+
+	for _, codeServer := range plan.remove {
+		if err := r.Client.Delete(ctx, &codeServer); client.IgnoreNotFound(err) != nil {
+			return fmt.Errorf("failed to delete CodeServer: %w", err)
+		}
+		if owner := codeServer.Spec.Owner; owner != nil && !ptr.Equal(owner, codeServerDeployments.Spec.Template.Spec.Owner) && !slices.Contains(codeServerDeployments.Spec.Owners, *owner) {
+			r.Recorder.Eventf(codeServerDeployments, corev1.EventTypeNormal, "ScaledDown", "Deleted CodeServer %s whose owner %s was removed", codeServer.Name, codeServer.Spec.Owner.Name)
+			continue
+		}
+		r.Recorder.Eventf(codeServerDeployments, corev1.EventTypeNormal, "ScaledDown", "Deleted CodeServer %s to scale down to %d replicas", codeServer.Name, codeServerDeployments.Spec.Replicas)
+	}
+
 	// 既存のCodeServerのSpecとCodeServerDeploymentのSpecが一致しているか確認
-	for _, codeServer := range codeServers.Items {
-		if !reflect.DeepEqual(codeServer.Spec, codeServerDeployments.Spec.Template.Spec) {
+	for i, codeServer := range plan.keep {
+		spec := replicaSpec(codeServerDeployments, plan.owners[i])
+		if !reflect.DeepEqual(codeServer.Spec, spec) {
 			patch := &unstructured.Unstructured{}
 			patch.SetGroupVersionKind(csv1alpha2.GroupVersion.WithKind("CodeServer"))
 			patch.SetNamespace(codeServerDeployments.Namespace)
@@ -116,7 +137,7 @@ func (r *CodeServerDeploymentReconciler) reconcileCodeServer(ctx context.Context
 				"app.kubernetes.io/created-by":        CodeServerManager,
 				"cs.walnuts.dev/codeserverdeployment": codeServerDeployments.Name,
 			})
-			patch.UnstructuredContent()["spec"] = codeServerDeployments.Spec.Template.Spec
+			patch.UnstructuredContent()["spec"] = spec
 			patch.SetOwnerReferences([]metav1.OwnerReference{
 				{
 					APIVersion:         codeServerDeployments.APIVersion,
@@ -128,26 +149,18 @@ func (r *CodeServerDeploymentReconciler) reconcileCodeServer(ctx context.Context
 				},
 			})
 
+			if err := migrateLegacyStatus(ctx, r.Client, &codeServer); err != nil {
+				return err
+			}
 			if err := r.Patch(ctx, patch, client.Apply, &client.PatchOptions{FieldManager: CodeServerManager, Force: ptr.To(true)}); err != nil {
 				return fmt.Errorf("failed to apply CodeServer: %w", err)
 			}
 			logger.Info("Patched CodeServer", "Name", codeServer.Name)
+			r.Recorder.Eventf(codeServerDeployments, corev1.EventTypeNormal, "Updated", "Updated CodeServer %s", codeServer.Name)
 		}
 	}
 
-	nowReplicas := int32(len(codeServers.Items))
-	if nowReplicas == codeServerDeployments.Spec.Replicas {
-		return nil
-	}
-
-	for i := nowReplicas; i > codeServerDeployments.Spec.Replicas; i-- {
-		codeServer := &codeServers.Items[i-1]
-		if err := r.Client.Delete(ctx, codeServer); err != nil {
-			return fmt.Errorf("failed to delete CodeServer: %w", err)
-		}
-	}
-
-	for i := nowReplicas; i < codeServerDeployments.Spec.Replicas; i++ {
+	for _, owner := range plan.create {
 		suffix, err := random.String(6, random.LowerLetters)
 		if err != nil {
 			logger.Error(err, "Failed to generate random string")
@@ -159,7 +172,7 @@ func (r *CodeServerDeploymentReconciler) reconcileCodeServer(ctx context.Context
 		codeServer.Namespace = codeServerDeployments.Namespace
 
 		op, err := ctrl.CreateOrUpdate(ctx, r.Client, codeServer, func() error {
-			codeServer.Spec = codeServerDeployments.Spec.Template.Spec
+			codeServer.Spec = replicaSpec(codeServerDeployments, owner)
 
 			if codeServer.Labels == nil {
 				codeServer.Labels = make(map[string]string)
@@ -180,8 +193,10 @@ func (r *CodeServerDeploymentReconciler) reconcileCodeServer(ctx context.Context
 		if op != controllerutil.OperationResultNone {
 			logger.Info("Reconciled CodeServer", "operation", op)
 		}
+		if op == controllerutil.OperationResultCreated {
+			r.Recorder.Eventf(codeServerDeployments, corev1.EventTypeNormal, "ScaledUp", "Created CodeServer %s to scale up to %d replicas", codeServer.Name, codeServerDeployments.Spec.Replicas)
+		}
 
-		continue
 	}
 
 	logger.Info("Reconcile CodeServer successfully")
@@ -189,6 +204,74 @@ func (r *CodeServerDeploymentReconciler) reconcileCodeServer(ctx context.Context
 
 }
 
+// replicaPlan is how the existing replicas of a CodeServerDeployment are reconciled into the desired replicas.
+type replicaPlan struct {
+	// keep is the replicas to keep, and owners is the owner of each of them, which is nil for the owner of the template.
+	keep   []csv1alpha2.CodeServer
+	owners []*csv1alpha2.CodeServerOwner
+	// remove is the replicas to delete.
+	remove []csv1alpha2.CodeServer
+	// create is the owners of the replicas to create.
+	create []*csv1alpha2.CodeServerOwner
+}
+
+// planReplicas plans the replicas so that each of the first replicas owners has its own replica,
+// and the other replicas have the owner of the template, which is template.
+// The owner of an existing replica is never changed to another one, since its home directory belongs to the owner:
+// a replica whose owner is neither one of owners nor template is deleted, and a new owner is given a new replica.
+// The replicas without an owner or with the owner of the template beyond replicas are deleted.
+func planReplicas(codeServers []csv1alpha2.CodeServer, template *csv1alpha2.CodeServerOwner, owners []csv1alpha2.CodeServerOwner, replicas int32) replicaPlan {
+	owners = owners[:min(len(owners), int(max(replicas, 0)))]
+
+	var plan replicaPlan
+	var unowned []csv1alpha2.CodeServer
+	claimed := make([]bool, len(owners))
+	for _, codeServer := range codeServers {
+		if owner := codeServer.Spec.Owner; owner != nil {
+			if j := slices.Index(owners, *owner); j >= 0 && !claimed[j] {
+				claimed[j] = true
+				plan.keep = append(plan.keep, codeServer)
+				plan.owners = append(plan.owners, &owners[j])
+				continue
+			}
+		}
+		if codeServer.Spec.Owner == nil || ptr.Equal(codeServer.Spec.Owner, template) {
+			unowned = append(unowned, codeServer)
+			continue
+		}
+		plan.remove = append(plan.remove, codeServer)
+	}
+
+	for j := range owners {
+		if !claimed[j] {
+			plan.create = append(plan.create, &owners[j])
+		}
+	}
+
+	free := max(int(replicas)-len(plan.keep)-len(plan.create), 0)
+	for i, codeServer := range unowned {
+		if i >= free {
+			plan.remove = append(plan.remove, codeServer)
+			continue
+		}
+		plan.keep = append(plan.keep, codeServer)
+		plan.owners = append(plan.owners, nil)
+	}
+	for i := len(unowned); i < free; i++ {
+		plan.create = append(plan.create, nil)
+	}
+	return plan
+}
+
+// replicaSpec returns the spec of a replica, which is the template with the owner assigned to the replica if any.
+func replicaSpec(codeServerDeployments *csv1alpha2.CodeServerDeployment, owner *csv1alpha2.CodeServerOwner) csv1alpha2.CodeServerSpec {
+	spec := *codeServerDeployments.Spec.Template.Spec.DeepCopy()
+	if owner != nil {
+		spec.Owner = owner.DeepCopy()
+	}
+	return spec
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *CodeServerDeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
@@ -23,6 +23,7 @@ import (
 	. "github.com/onsi/gomega"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -69,8 +70,9 @@ var _ = Describe("CodeServerDeployment Controller", func() {
 		It("should successfully reconcile the resource", func() {
 			By("Reconciling the created resource")
 			controllerReconciler := &CodeServerDeploymentReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(100),
 			}
 
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
@@ -81,4 +83,94 @@ var _ = Describe("CodeServerDeployment Controller", func() {
 			// Example: If you expect a certain status condition after reconciliation, verify it here.
 		})
 	})
+
+	Context("When assigning the owners", func() {
+		alice := csv1alpha2.CodeServerOwner{Kind: csv1alpha2.OwnerKindUser, Name: "alice"}
+		bob := csv1alpha2.CodeServerOwner{Kind: csv1alpha2.OwnerKindUser, Name: "bob"}
+		carol := csv1alpha2.CodeServerOwner{Kind: csv1alpha2.OwnerKindUser, Name: "carol"}
+
+		ownedBy := func(name string, owner *csv1alpha2.CodeServerOwner) csv1alpha2.CodeServer {
+			return csv1alpha2.CodeServer{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec:       csv1alpha2.CodeServerSpec{Owner: owner},
+			}
+		}
+
+		names := func(codeServers []csv1alpha2.CodeServer) []string {
+			result := make([]string, 0, len(codeServers))
+			for _, codeServer := range codeServers {
+				result = append(result, codeServer.Name)
+			}
+			return result
+		}
+
+		It("should keep the owners of the existing replicas and create new replicas for the new owners", func() {
+			codeServers := []csv1alpha2.CodeServer{
+				ownedBy("a", nil),
+				ownedBy("b", &bob),
+			}
+			plan := planReplicas(codeServers, nil, []csv1alpha2.CodeServerOwner{alice, bob, carol}, 4)
+			Expect(names(plan.keep)).To(Equal([]string{"b", "a"}))
+			Expect(plan.owners).To(Equal([]*csv1alpha2.CodeServerOwner{&bob, nil}))
+			Expect(plan.create).To(Equal([]*csv1alpha2.CodeServerOwner{&alice, &carol}))
+			Expect(plan.remove).To(BeEmpty())
+		})
+
+		It("should scale in the replicas without an owner", func() {
+			codeServers := []csv1alpha2.CodeServer{
+				ownedBy("a", nil),
+				ownedBy("b", &bob),
+				ownedBy("c", nil),
+			}
+			plan := planReplicas(codeServers, nil, []csv1alpha2.CodeServerOwner{bob}, 2)
+			Expect(names(plan.keep)).To(Equal([]string{"b", "a"}))
+			Expect(names(plan.remove)).To(Equal([]string{"c"}))
+			Expect(plan.create).To(BeEmpty())
+		})
+
+		It("should delete the replica of the removed owner instead of giving it to another owner", func() {
+			codeServers := []csv1alpha2.CodeServer{
+				ownedBy("b", &bob),
+				ownedBy("c", &carol),
+			}
+			plan := planReplicas(codeServers, nil, []csv1alpha2.CodeServerOwner{bob, alice}, 2)
+			Expect(names(plan.keep)).To(Equal([]string{"b"}))
+			Expect(names(plan.remove)).To(Equal([]string{"c"}))
+			Expect(plan.create).To(Equal([]*csv1alpha2.CodeServerOwner{&alice}))
+		})
+
+		It("should keep the replicas with the owner of the template", func() {
+			codeServers := []csv1alpha2.CodeServer{
+				ownedBy("a", &alice),
+				ownedBy("b", &bob),
+			}
+			plan := planReplicas(codeServers, &alice, []csv1alpha2.CodeServerOwner{bob}, 2)
+			Expect(names(plan.keep)).To(Equal([]string{"b", "a"}))
+			Expect(plan.owners).To(Equal([]*csv1alpha2.CodeServerOwner{&bob, nil}))
+			Expect(plan.remove).To(BeEmpty())
+			Expect(plan.create).To(BeEmpty())
+		})
+
+		It("should delete the duplicated replicas of an owner", func() {
+			codeServers := []csv1alpha2.CodeServer{
+				ownedBy("b", &bob),
+				ownedBy("b2", &bob),
+			}
+			plan := planReplicas(codeServers, nil, []csv1alpha2.CodeServerOwner{bob}, 2)
+			Expect(names(plan.keep)).To(Equal([]string{"b"}))
+			Expect(names(plan.remove)).To(Equal([]string{"b2"}))
+			Expect(plan.create).To(Equal([]*csv1alpha2.CodeServerOwner{nil}))
+		})
+
+		It("should override the owner of the template", func() {
+			codeServerDeployment := &csv1alpha2.CodeServerDeployment{
+				Spec: csv1alpha2.CodeServerDeploymentSpec{
+					Template: csv1alpha2.CodeServersTemplate{Spec: csv1alpha2.CodeServerSpec{Owner: &alice}},
+				},
+			}
+			Expect(replicaSpec(codeServerDeployment, &bob).Owner).To(Equal(&bob))
+			Expect(replicaSpec(codeServerDeployment, nil).Owner).To(Equal(&alice))
+			Expect(codeServerDeployment.Spec.Template.Spec.Owner).To(Equal(&alice))
+		})
+	})
 })
@@ -0,0 +1,295 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	"github.com/robfig/cron/v3"
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// CodeServerSnapshotLabel is the label of VolumeSnapshots that records the name of the CodeServerSnapshot.
+const CodeServerSnapshotLabel = "cs.walnuts.dev/codeserversnapshot"
+
+// codeServerNotFoundRetryInterval is the interval to wait for the snapshotted CodeServer to be created.
+const codeServerNotFoundRetryInterval = time.Minute
+
+// CodeServerSnapshotReconciler reconciles a CodeServerSnapshot object
+type CodeServerSnapshotReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=cs.walnuts.dev,resources=codeserversnapshots,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cs.walnuts.dev,resources=codeserversnapshots/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=cs.walnuts.dev,resources=codeserversnapshots/finalizers,verbs=update
+
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+
+// Reconcile takes a VolumeSnapshot of the home volume of the CodeServer when it is due,
+// and deletes the snapshots exceeding the retention count.
+func (r *CodeServerSnapshotReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	var codeServerSnapshot csv1alpha2.CodeServerSnapshot
+	err := r.Get(ctx, req.NamespacedName, &codeServerSnapshot)
+	if errors.IsNotFound(err) {
+		logger.Info("CodeServerSnapshot resource not found. Ignoring since object must be deleted")
+		return ctrl.Result{}, nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get CodeServerSnapshot")
+		return ctrl.Result{}, err
+	}
+	if !codeServerSnapshot.ObjectMeta.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	status := codeServerSnapshot.Status.DeepCopy()
+
+	var codeServer csv1alpha2.CodeServer
+	err = r.Get(ctx, client.ObjectKey{Name: codeServerSnapshot.Spec.CodeServerName, Namespace: codeServerSnapshot.Namespace}, &codeServer)
+	if errors.IsNotFound(err) {
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               csv1alpha2.ConditionTypeSnapshotReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "CodeServerNotFound",
+			Message:            fmt.Sprintf("CodeServer %q is not found", codeServerSnapshot.Spec.CodeServerName),
+			ObservedGeneration: codeServerSnapshot.Generation,
+		})
+		return ctrl.Result{RequeueAfter: codeServerNotFoundRetryInterval}, r.updateStatus(ctx, codeServerSnapshot, status)
+	}
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get CodeServer: %w", err)
+	}
+
+	snapshots, err := r.listVolumeSnapshots(ctx, codeServerSnapshot)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := time.Now()
+	var requeueAfter time.Duration
+	if codeServerSnapshot.Spec.Schedule == "" {
+		if len(snapshots) == 0 {
+			snapshot, err := r.createVolumeSnapshot(ctx, codeServerSnapshot, codeServer, codeServerSnapshot.Name)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if snapshot != nil {
+				snapshots = append(snapshots, *snapshot)
+			}
+		}
+		status.NextSnapshotTime = nil
+	} else {
+		schedule, err := cron.ParseStandard(codeServerSnapshot.Spec.Schedule)
+		if err != nil {
+			meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               csv1alpha2.ConditionTypeSnapshotReady,
+				Status:             metav1.ConditionFalse,
+				Reason:             "InvalidSchedule",
+				Message:            fmt.Sprintf("failed to parse schedule: %v", err),
+				ObservedGeneration: codeServerSnapshot.Generation,
+			})
+			return ctrl.Result{}, r.updateStatus(ctx, codeServerSnapshot, status)
+		}
+
+		last := codeServerSnapshot.CreationTimestamp.Time
+		if len(snapshots) > 0 {
+			last = snapshots[len(snapshots)-1].CreationTimestamp.Time
+		}
+		if slot := schedule.Next(last); !slot.After(now) {
+			snapshot, err := r.createVolumeSnapshot(ctx, codeServerSnapshot, codeServer, scheduledSnapshotName(codeServerSnapshot.Name, slot))
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if snapshot != nil {
+				snapshots = append(snapshots, *snapshot)
+			}
+		}
+
+		pruned := snapshotsToPrune(snapshots, codeServerSnapshot.Spec.RetentionCount)
+		for _, snapshot := range pruned {
+			if err := r.Delete(ctx, &snapshot); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to delete VolumeSnapshot: %w", err)
+			}
+			logger.Info("VolumeSnapshot has been pruned.", "name", snapshot.Name, "namespace", snapshot.Namespace)
+		}
+		snapshots = snapshots[len(pruned):]
+
+		next := schedule.Next(now)
+		status.NextSnapshotTime = &metav1.Time{Time: next}
+		requeueAfter = next.Sub(now)
+	}
+
+	status.Snapshots = make([]csv1alpha2.VolumeSnapshotStatus, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		status.Snapshots = append(status.Snapshots, csv1alpha2.VolumeSnapshotStatus{
+			Name:         snapshot.Name,
+			CreationTime: snapshot.CreationTimestamp,
+			ReadyToUse:   snapshot.Status != nil && ptr.Deref(snapshot.Status.ReadyToUse, false),
+		})
+	}
+	if len(snapshots) > 0 {
+		latest := snapshots[len(snapshots)-1]
+		status.LastSnapshotTime = &latest.CreationTimestamp
+		condition := snapshotCondition(latest)
+		condition.ObservedGeneration = codeServerSnapshot.Generation
+		meta.SetStatusCondition(&status.Conditions, condition)
+	}
+
+	return ctrl.Result{RequeueAfter: requeueAfter}, r.updateStatus(ctx, codeServerSnapshot, status)
+}
+
+// listVolumeSnapshots returns the VolumeSnapshots taken by the CodeServerSnapshot, oldest first.
+func (r *CodeServerSnapshotReconciler) listVolumeSnapshots(ctx context.Context, codeServerSnapshot csv1alpha2.CodeServerSnapshot) ([]snapshotv1.VolumeSnapshot, error) {
+	var list snapshotv1.VolumeSnapshotList
+	if err := r.List(ctx, &list, client.InNamespace(codeServerSnapshot.Namespace), client.MatchingLabels{CodeServerSnapshotLabel: codeServerSnapshot.Name}); err != nil {
+		return nil, fmt.Errorf("failed to list VolumeSnapshot: %w", err)
+	}
+
+	snapshots := make([]snapshotv1.VolumeSnapshot, 0, len(list.Items))
+	for _, snapshot := range list.Items {
+		if snapshot.DeletionTimestamp.IsZero() {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i].CreationTimestamp.Before(&snapshots[j].CreationTimestamp)
+	})
+	return snapshots, nil
+}
+
+// createVolumeSnapshot creates the VolumeSnapshot of the home volume of code server.
+// It returns nil if the VolumeSnapshot already exists, which is taken by a previous reconcile not yet in the cache.
+func (r *CodeServerSnapshotReconciler) createVolumeSnapshot(ctx context.Context, codeServerSnapshot csv1alpha2.CodeServerSnapshot, codeServer csv1alpha2.CodeServer, name string) (*snapshotv1.VolumeSnapshot, error) {
+	logger := log.FromContext(ctx)
+
+	snapshot := &snapshotv1.VolumeSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: codeServerSnapshot.Namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       CodeServer,
+				"app.kubernetes.io/instance":   codeServer.Name,
+				"app.kubernetes.io/created-by": CodeServerManager,
+				CodeServerSnapshotLabel:        codeServerSnapshot.Name,
+			},
+		},
+		Spec: snapshotv1.VolumeSnapshotSpec{
+			Source: snapshotv1.VolumeSnapshotSource{
+				PersistentVolumeClaimName: ptr.To(codeServer.HomeClaimName()),
+			},
+			VolumeSnapshotClassName: codeServerSnapshot.Spec.VolumeSnapshotClassName,
+		},
+	}
+	if err := ctrl.SetControllerReference(&codeServerSnapshot, snapshot, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, snapshot); errors.IsAlreadyExists(err) {
+		logger.Info("VolumeSnapshot already exists.", "name", snapshot.Name, "namespace", snapshot.Namespace)
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create VolumeSnapshot: %w", err)
+	}
+
+	logger.Info("VolumeSnapshot has been created.", "name", snapshot.Name, "namespace", snapshot.Namespace)
+	return snapshot, nil
+}
+
+func (r *CodeServerSnapshotReconciler) updateStatus(ctx context.Context, codeServerSnapshot csv1alpha2.CodeServerSnapshot, status *csv1alpha2.CodeServerSnapshotStatus) error {
+	if equality.Semantic.DeepEqual(codeServerSnapshot.Status, *status) {
+		return nil
+	}
+	codeServerSnapshot.Status = *status
+	if err := r.Status().Update(ctx, &codeServerSnapshot); err != nil {
+		return fmt.Errorf("failed to update CodeServerSnapshot status: %w", err)
+	}
+	return nil
+}
+
+// scheduledSnapshotName returns the name of the VolumeSnapshot taken at the scheduled slot.
+// The name is derived from the slot rather than the current time, so that the snapshot of a slot is never taken twice.
+func scheduledSnapshotName(name string, slot time.Time) string {
+	return fmt.Sprintf("%s-%s", name, slot.UTC().Format("20060102150405"))
+}
+
+// snapshotsToPrune returns the oldest snapshots exceeding the retention count.
+// The snapshots must be sorted oldest first.
+func snapshotsToPrune(snapshots []snapshotv1.VolumeSnapshot, retentionCount int32) []snapshotv1.VolumeSnapshot {
+	prune := len(snapshots) - int(retentionCount)
+	if prune <= 0 {
+		return nil
+	}
+	return snapshots[:prune]
+}
+
+// snapshotCondition returns the SnapshotReady condition observed from the VolumeSnapshot.
+func snapshotCondition(snapshot snapshotv1.VolumeSnapshot) metav1.Condition {
+	condition := metav1.Condition{
+		Type:    csv1alpha2.ConditionTypeSnapshotReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  "Creating",
+		Message: fmt.Sprintf("VolumeSnapshot %q is being created", snapshot.Name),
+	}
+	switch {
+	case snapshot.Status == nil:
+	case snapshot.Status.Error != nil:
+		condition.Reason = "SnapshotFailed"
+		condition.Message = fmt.Sprintf("VolumeSnapshot %q failed: %s", snapshot.Name, ptr.Deref(snapshot.Status.Error.Message, "unknown error"))
+	case ptr.Deref(snapshot.Status.ReadyToUse, false):
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "ReadyToUse"
+		condition.Message = fmt.Sprintf("VolumeSnapshot %q is ready to use", snapshot.Name)
+	}
+	return condition
+}
+
+// VolumeSnapshotAvailable reports whether the VolumeSnapshot CRDs are installed in the cluster.
+func VolumeSnapshotAvailable(mapper meta.RESTMapper) (bool, error) {
+	_, err := mapper.RESTMapping(schema.GroupKind{Group: snapshotv1.GroupName, Kind: "VolumeSnapshot"}, snapshotv1.SchemeGroupVersion.Version)
+	if meta.IsNoMatchError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CodeServerSnapshotReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&csv1alpha2.CodeServerSnapshot{}).
+		Owns(&snapshotv1.VolumeSnapshot{}).
+		Complete(r)
+}
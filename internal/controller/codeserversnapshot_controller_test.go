@@ -0,0 +1,79 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v8/apis/volumesnapshot/v1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+var _ = Describe("CodeServerSnapshot Controller", func() {
+	Context("When pruning snapshots", func() {
+		snapshots := []snapshotv1.VolumeSnapshot{
+			{ObjectMeta: metav1.ObjectMeta{Name: "backup-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "backup-2"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "backup-3"}},
+		}
+
+		It("should prune the oldest snapshots exceeding the retention count", func() {
+			pruned := snapshotsToPrune(snapshots, 1)
+			Expect(pruned).To(HaveLen(2))
+			Expect(pruned[0].Name).To(Equal("backup-1"))
+			Expect(pruned[1].Name).To(Equal("backup-2"))
+		})
+
+		It("should not prune snapshots within the retention count", func() {
+			Expect(snapshotsToPrune(snapshots, 3)).To(BeEmpty())
+			Expect(snapshotsToPrune(snapshots, 5)).To(BeEmpty())
+		})
+	})
+
+	Context("When scheduling snapshots", func() {
+		It("should name the snapshot after the scheduled slot", func() {
+			schedule, err := cron.ParseStandard("CRON_TZ=UTC 0 3 * * *")
+			Expect(err).NotTo(HaveOccurred())
+
+			// The snapshot taken in the previous slot, while the one just taken is not in the cache yet.
+			last := time.Date(2024, 3, 31, 3, 0, 12, 0, time.UTC)
+			Expect(scheduledSnapshotName("backup", schedule.Next(last))).To(Equal("backup-20240401030000"))
+		})
+	})
+
+	Context("When observing the snapshot", func() {
+		DescribeTable("should report the SnapshotReady condition",
+			func(status *snapshotv1.VolumeSnapshotStatus, conditionStatus metav1.ConditionStatus, reason string) {
+				snapshot := snapshotv1.VolumeSnapshot{
+					ObjectMeta: metav1.ObjectMeta{Name: "backup"},
+					Status:     status,
+				}
+				condition := snapshotCondition(snapshot)
+				Expect(condition.Status).To(Equal(conditionStatus))
+				Expect(condition.Reason).To(Equal(reason))
+			},
+			Entry("not yet observed", nil, metav1.ConditionFalse, "Creating"),
+			Entry("creating", &snapshotv1.VolumeSnapshotStatus{ReadyToUse: ptr.To(false)}, metav1.ConditionFalse, "Creating"),
+			Entry("failed", &snapshotv1.VolumeSnapshotStatus{Error: &snapshotv1.VolumeSnapshotError{Message: ptr.To("driver error")}}, metav1.ConditionFalse, "SnapshotFailed"),
+			Entry("ready", &snapshotv1.VolumeSnapshotStatus{ReadyToUse: ptr.To(true)}, metav1.ConditionTrue, "ReadyToUse"),
+		)
+	})
+})
@@ -24,6 +24,15 @@ var plugins = map[string]func(params map[string]string) (common.PluginInterface,
 	},
 }
 
+// privilegedPlugins are the plugins that need privilege escalation (e.g. sudo) to run.
+var privilegedPlugins = map[string]bool{
+	"copyHome": true,
+}
+
+func RequiresPrivilegeEscalation(name string) bool {
+	return privilegedPlugins[name]
+}
+
 func CreatePlugin(initpluginConfig map[string]map[string]string, commonParams common.CommonFields) ([]*corev1apply.ContainerApplyConfiguration, error) {
 	containers := make([]*corev1apply.ContainerApplyConfiguration, 0, len(initpluginConfig))
 
@@ -46,3 +55,16 @@ func CreatePlugin(initpluginConfig map[string]map[string]string, commonParams co
 	}
 	return containers, nil
 }
+
+// PluginNames returns the names of the plugins keyed by the names of their init containers.
+func PluginNames(initpluginConfig map[string]map[string]string, commonParams common.CommonFields) (map[string]string, error) {
+	names := make(map[string]string, len(initpluginConfig))
+	for name, parameters := range initpluginConfig {
+		containers, err := CreatePlugin(map[string]map[string]string{name: parameters}, commonParams)
+		if err != nil {
+			return nil, err
+		}
+		names[*containers[0].Name] = name
+	}
+	return names, nil
+}
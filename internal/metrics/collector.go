@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// listTimeout bounds listing the CodeServers on a scrape.
+const listTimeout = 10 * time.Second
+
+var (
+	codeServersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "codeservers"),
+		"Number of CodeServers by phase.",
+		[]string{"namespace", "phase"}, nil,
+	)
+	pvcCapacityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pvc_capacity_bytes"),
+		"Capacity of the home volume of the CodeServer.",
+		[]string{"namespace", "codeserver"}, nil,
+	)
+)
+
+// Collector collects the metrics of the state of the CodeServers on every scrape.
+type Collector struct {
+	client client.Reader
+}
+
+var _ prometheus.Collector = &Collector{}
+
+// NewCollector returns a Collector listing the CodeServers with c, which is usually the cached client of the manager.
+func NewCollector(c client.Reader) *Collector {
+	return &Collector{client: c}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- codeServersDesc
+	ch <- pvcCapacityDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+
+	var codeServers csv1alpha2.CodeServerList
+	if err := c.client.List(ctx, &codeServers); err != nil {
+		logf.Log.WithName("metrics").Error(err, "Failed to list CodeServers.")
+		return
+	}
+
+	type key struct {
+		namespace string
+		phase     csv1alpha2.CodeServerPhase
+	}
+	phases := make(map[key]int)
+	for _, codeServer := range codeServers.Items {
+		phase := codeServer.Status.Phase
+		if phase == "" {
+			phase = csv1alpha2.CodeServerNotReady
+		}
+		phases[key{codeServer.Namespace, phase}]++
+
+		if storage := codeServer.Status.Storage; storage != nil && storage.Capacity != nil {
+			ch <- prometheus.MustNewConstMetric(pvcCapacityDesc, prometheus.GaugeValue, storage.Capacity.AsApproximateFloat64(), codeServer.Namespace, codeServer.Name)
+		}
+	}
+	for k, count := range phases {
+		ch <- prometheus.MustNewConstMetric(codeServersDesc, prometheus.GaugeValue, float64(count), k.namespace, string(k.phase))
+	}
+}
@@ -0,0 +1,88 @@
+// Package metrics defines the Prometheus metrics of the CodeServers, served with the metrics of controller-runtime.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "codeserver"
+
+var (
+	timeToReady = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_ready_seconds",
+		Help:      "Time for code server to become ready after the CodeServer is created.",
+		Buckets:   []float64{5, 10, 20, 30, 60, 120, 300, 600, 1200},
+	}, []string{"namespace"})
+
+	initPluginFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "init_plugin_failures_total",
+		Help:      "Number of failed runs of the init containers of the init plugins.",
+	}, []string{"namespace", "plugin"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(timeToReady, initPluginFailures)
+}
+
+// ObserveTimeToReady records the time for code server in namespace to become ready since start.
+func ObserveTimeToReady(namespace string, start time.Time, now time.Time) {
+	timeToReady.WithLabelValues(namespace).Observe(now.Sub(start).Seconds())
+}
+
+// failureCounts holds the failures of the init containers already counted, per CodeServer, pod and container.
+var failureCounts = struct {
+	sync.Mutex
+	counted map[types.NamespacedName]map[types.UID]map[string]int32
+}{counted: make(map[types.NamespacedName]map[types.UID]map[string]int32)}
+
+// RecordInitPluginFailures counts the new failures of the init containers in the pods of the CodeServer.
+// plugins maps the names of the init containers to the names of the init plugins, other init containers are ignored.
+// The pods which no longer exist are forgotten.
+func RecordInitPluginFailures(codeServer types.NamespacedName, pods []corev1.Pod, plugins map[string]string) {
+	failureCounts.Lock()
+	defer failureCounts.Unlock()
+
+	previous := failureCounts.counted[codeServer]
+	current := make(map[types.UID]map[string]int32, len(pods))
+	for _, pod := range pods {
+		counts := make(map[string]int32)
+		for _, status := range pod.Status.InitContainerStatuses {
+			plugin, ok := plugins[status.Name]
+			if !ok {
+				continue
+			}
+			failures := containerFailures(status)
+			counts[status.Name] = failures
+			if delta := failures - previous[pod.UID][status.Name]; delta > 0 {
+				initPluginFailures.WithLabelValues(codeServer.Namespace, plugin).Add(float64(delta))
+			}
+		}
+		current[pod.UID] = counts
+	}
+	failureCounts.counted[codeServer] = current
+}
+
+// Forget forgets the failures counted for the deleted CodeServer.
+func Forget(codeServer types.NamespacedName) {
+	failureCounts.Lock()
+	defer failureCounts.Unlock()
+	delete(failureCounts.counted, codeServer)
+}
+
+// containerFailures returns the number of times the init container has failed.
+// An init container is restarted only when it fails, so every restart is a failure.
+func containerFailures(status corev1.ContainerStatus) int32 {
+	failures := status.RestartCount
+	if terminated := status.State.Terminated; terminated != nil && terminated.ExitCode != 0 {
+		failures++
+	}
+	return failures
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	csv1alpha2 "github.com/walnuts1018/code-server-operator/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func initContainerPod(uid types.UID, restartCount int32, exitCode int32) corev1.Pod {
+	return corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{UID: uid},
+		Status: corev1.PodStatus{
+			InitContainerStatuses: []corev1.ContainerStatus{
+				{
+					Name:         "git",
+					RestartCount: restartCount,
+					State:        corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode}},
+				},
+				{
+					Name:         "setup",
+					RestartCount: restartCount,
+					State:        corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: exitCode}},
+				},
+			},
+		},
+	}
+}
+
+func TestRecordInitPluginFailures(t *testing.T) {
+	codeServer := types.NamespacedName{Namespace: "team-a", Name: "alice"}
+	plugins := map[string]string{"git": "git"}
+	failures := initPluginFailures.WithLabelValues("team-a", "git")
+	defer Forget(codeServer)
+
+	steps := []struct {
+		name string
+		pods []corev1.Pod
+		want float64
+	}{
+		{name: "succeeded", pods: []corev1.Pod{initContainerPod("pod-1", 0, 0)}, want: 0},
+		{name: "failed", pods: []corev1.Pod{initContainerPod("pod-1", 0, 1)}, want: 1},
+		{name: "observed again", pods: []corev1.Pod{initContainerPod("pod-1", 0, 1)}, want: 1},
+		{name: "restarted and failed", pods: []corev1.Pod{initContainerPod("pod-1", 2, 1)}, want: 3},
+		{name: "recreated", pods: []corev1.Pod{initContainerPod("pod-2", 0, 1)}, want: 4},
+	}
+	for _, step := range steps {
+		RecordInitPluginFailures(codeServer, step.pods, plugins)
+		if got := testutil.ToFloat64(failures); got != step.want {
+			t.Errorf("%s: failures = %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestCollector(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := csv1alpha2.AddToScheme(scheme); err != nil {
+		t.Fatalf("failed to add scheme: %v", err)
+	}
+
+	capacity := resource.MustParse("10Gi")
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&csv1alpha2.CodeServer{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "alice"},
+			Status: csv1alpha2.CodeServerStatus{
+				Phase:   csv1alpha2.CodeServerReady,
+				Storage: &csv1alpha2.CodeServerStorageStatus{Capacity: &capacity},
+			},
+		},
+		&csv1alpha2.CodeServer{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "bob"},
+			Status:     csv1alpha2.CodeServerStatus{Phase: csv1alpha2.CodeServerReady},
+		},
+		&csv1alpha2.CodeServer{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "team-b", Name: "carol"},
+		},
+	).Build()
+
+	expected := `
+# HELP codeserver_codeservers Number of CodeServers by phase.
+# TYPE codeserver_codeservers gauge
+codeserver_codeservers{namespace="team-a",phase="Ready"} 2
+codeserver_codeservers{namespace="team-b",phase="NotReady"} 1
+# HELP codeserver_pvc_capacity_bytes Capacity of the home volume of the CodeServer.
+# TYPE codeserver_pvc_capacity_bytes gauge
+codeserver_pvc_capacity_bytes{codeserver="alice",namespace="team-a"} 1.073741824e+10
+`
+	if err := testutil.CollectAndCompare(NewCollector(c), strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,81 @@
+// Package portscan detects the ports a host is listening on by connecting to them.
+package portscan
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// concurrency is the maximum number of connections in flight.
+const concurrency = 128
+
+// Range is an inclusive range of ports.
+type Range struct {
+	Start int32
+	End   int32
+}
+
+// Ports returns the ports within allow and not within deny in ascending order.
+func Ports(allow []Range, deny []Range) []int32 {
+	var ports []int32
+	for _, r := range allow {
+		for port := max(r.Start, 1); port <= min(r.End, 65535); port++ {
+			if !contains(deny, port) {
+				ports = append(ports, port)
+			}
+		}
+	}
+	slices.Sort(ports)
+	return slices.Compact(ports)
+}
+
+func contains(ranges []Range, port int32) bool {
+	for _, r := range ranges {
+		if r.Start <= port && port <= r.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan returns the ports of host accepting TCP connections within timeout in ascending order.
+// It returns the error of ctx if ctx is done before all the ports are scanned, with the ports found so far.
+func Scan(ctx context.Context, host string, ports []int32, timeout time.Duration) ([]int32, error) {
+	var (
+		mu   sync.Mutex
+		open []int32
+		wg   sync.WaitGroup
+	)
+
+	dialer := net.Dialer{Timeout: timeout}
+	sem := make(chan struct{}, concurrency)
+	for _, port := range ports {
+		if ctx.Err() != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(port int32) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+
+			mu.Lock()
+			open = append(open, port)
+			mu.Unlock()
+		}(port)
+	}
+	wg.Wait()
+
+	slices.Sort(open)
+	return open, ctx.Err()
+}
@@ -0,0 +1,80 @@
+package portscan
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow []Range
+		deny  []Range
+		want  []int32
+	}{
+		{
+			name:  "ranges are merged in ascending order",
+			allow: []Range{{Start: 8000, End: 8002}, {Start: 3000, End: 3000}, {Start: 8001, End: 8003}},
+			want:  []int32{3000, 8000, 8001, 8002, 8003},
+		},
+		{
+			name:  "denied ports are excluded",
+			allow: []Range{{Start: 3000, End: 3005}},
+			deny:  []Range{{Start: 3001, End: 3002}, {Start: 3005, End: 3005}},
+			want:  []int32{3000, 3003, 3004},
+		},
+		{
+			name:  "ports out of range are ignored",
+			allow: []Range{{Start: -1, End: 1}, {Start: 65535, End: 70000}},
+			want:  []int32{1, 65535},
+		},
+		{
+			name: "nothing is allowed",
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Ports(tt.allow, tt.deny); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Ports() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScan(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listening := int32(listener.Addr().(*net.TCPAddr).Port)
+
+	// Find a closed port by closing another listener.
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := int32(closedListener.Addr().(*net.TCPAddr).Port)
+	closedListener.Close()
+
+	got, err := Scan(context.Background(), "127.0.0.1", []int32{closed, listening}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int32{listening}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Scan() = %v, want %v", got, want)
+	}
+}
+
+func TestScanCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := Scan(ctx, "127.0.0.1", []int32{1024, 1025}, time.Second); err == nil {
+		t.Error("Scan() should fail if the context is done before all the ports are scanned")
+	}
+}
@@ -19,6 +19,7 @@ package e2e
 import (
 	"fmt"
 	"os/exec"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -118,4 +119,232 @@ var _ = Describe("controller", Ordered, func() {
 
 		})
 	})
+
+	Context("OAuth2Proxy", func() {
+		const mockOIDCManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: mock-oauth2-server
+  namespace: default
+spec:
+  selector:
+    matchLabels:
+      app: mock-oauth2-server
+  template:
+    metadata:
+      labels:
+        app: mock-oauth2-server
+    spec:
+      containers:
+      - name: mock-oauth2-server
+        image: ghcr.io/navikt/mock-oauth2-server:2.1.10
+        ports:
+        - containerPort: 8080
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: mock-oauth2-server
+  namespace: default
+spec:
+  selector:
+    app: mock-oauth2-server
+  ports:
+  - port: 8080
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: mock-oidc-client
+  namespace: default
+stringData:
+  client-secret: mock-client-secret
+---
+apiVersion: cs.walnuts.dev/v1alpha2
+kind: CodeServer
+metadata:
+  name: mock-oidc
+  namespace: default
+spec:
+  storageSize: 512Mi
+  exposure: None
+  auth:
+    mode: OAuth2Proxy
+    oauth2Proxy:
+      issuerURL: http://mock-oauth2-server.default.svc:8080/default
+      clientID: code-server
+      clientSecretName: mock-oidc-client
+      extraArgs:
+      - --insecure-oidc-allow-unverified-email=true
+`
+
+		// curl runs curl in a pod of the cluster and returns its output.
+		curl := func(args ...string) (string, error) {
+			cmd := exec.Command("kubectl", append([]string{"run", "curl", "-n", "default", "--rm", "-i", "-q", "--restart=Never",
+				"--image=curlimages/curl:8.10.1", "--", "curl", "-s"}, args...)...)
+			output, err := utils.Run(cmd)
+			return string(output), err
+		}
+
+		AfterAll(func() {
+			cmd := exec.Command("kubectl", "delete", "--ignore-not-found", "-f", "-")
+			cmd.Stdin = strings.NewReader(mockOIDCManifest)
+			_, _ = utils.Run(cmd)
+		})
+
+		It("should authenticate the users with the mock OIDC provider", func() {
+			By("deploying the mock OIDC provider and a CodeServer authenticated by it")
+			cmd := exec.Command("kubectl", "apply", "-f", "-")
+			cmd.Stdin = strings.NewReader(mockOIDCManifest)
+			_, err := utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+			By("waiting for oauth2-proxy to discover the issuer and code server to be ready")
+			EventuallyWithOffset(1, func() error {
+				cmd := exec.Command("kubectl", "rollout", "status", "deployment/mock-oidc", "-n", "default", "--timeout=10s")
+				_, err := utils.Run(cmd)
+				return err
+			}, 10*time.Minute, 10*time.Second).Should(Succeed())
+
+			By("redirecting the unauthenticated users to the issuer")
+			output, err := curl("-o", "/dev/null", "-w", "%{redirect_url}", "http://mock-oidc.default.svc:19200/")
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			ExpectWithOffset(1, output).To(HavePrefix("http://mock-oauth2-server.default.svc:8080/default/authorize?"))
+
+			By("refusing the connections to code server bypassing oauth2-proxy")
+			cmd = exec.Command("kubectl", "get", "pods", "-n", "default", "-l", "app.kubernetes.io/instance=mock-oidc",
+				"-o", "jsonpath={.items[0].status.podIP}")
+			podIP, err := utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			_, err = curl("--max-time", "5", fmt.Sprintf("http://%s:19200/healthz", podIP))
+			ExpectWithOffset(1, err).To(HaveOccurred())
+		})
+	})
+
+	Context("Archive", func() {
+		const minioManifest = `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: minio
+  namespace: default
+spec:
+  selector:
+    matchLabels:
+      app: minio
+  template:
+    metadata:
+      labels:
+        app: minio
+    spec:
+      containers:
+      - name: minio
+        image: minio/minio:RELEASE.2024-10-13T13-34-11Z
+        args: ["server", "/data"]
+        env:
+        - name: MINIO_ROOT_USER
+          value: minioadmin
+        - name: MINIO_ROOT_PASSWORD
+          value: minioadmin
+        ports:
+        - containerPort: 9000
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: minio
+  namespace: default
+spec:
+  selector:
+    app: minio
+  ports:
+  - port: 9000
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: minio-credentials
+  namespace: default
+stringData:
+  AWS_ACCESS_KEY_ID: minioadmin
+  AWS_SECRET_ACCESS_KEY: minioadmin
+`
+		const codeServerManifest = `
+apiVersion: cs.walnuts.dev/v1alpha2
+kind: CodeServer
+metadata:
+  name: archived
+  namespace: default
+spec:
+  storageSize: 512Mi
+  exposure: None
+  reclaimPolicy: Archive
+  archive:
+    endpoint: http://minio.default.svc:9000
+    bucket: workspaces
+    credentialsSecretName: minio-credentials
+`
+
+		// aws runs the AWS CLI against MinIO in a pod of the cluster and returns its output.
+		aws := func(args ...string) (string, error) {
+			cmd := exec.Command("kubectl", append([]string{"run", "aws", "-n", "default", "--rm", "-i", "-q", "--restart=Never",
+				"--image=amazon/aws-cli:2.17.0",
+				"--env=AWS_ACCESS_KEY_ID=minioadmin", "--env=AWS_SECRET_ACCESS_KEY=minioadmin", "--env=AWS_DEFAULT_REGION=us-east-1",
+				"--", "--endpoint-url", "http://minio.default.svc:9000"}, args...)...)
+			output, err := utils.Run(cmd)
+			return string(output), err
+		}
+
+		AfterAll(func() {
+			for _, manifest := range []string{codeServerManifest, minioManifest} {
+				cmd := exec.Command("kubectl", "delete", "--ignore-not-found", "-f", "-")
+				cmd.Stdin = strings.NewReader(manifest)
+				_, _ = utils.Run(cmd)
+			}
+		})
+
+		It("should archive the home directory to MinIO when the CodeServer is deleted", func() {
+			By("deploying MinIO with a bucket")
+			cmd := exec.Command("kubectl", "apply", "-f", "-")
+			cmd.Stdin = strings.NewReader(minioManifest)
+			_, err := utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			cmd = exec.Command("kubectl", "rollout", "status", "deployment/minio", "-n", "default", "--timeout=5m")
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			EventuallyWithOffset(1, func() error {
+				_, err := aws("s3", "mb", "s3://workspaces")
+				return err
+			}, time.Minute, 5*time.Second).Should(Succeed())
+
+			By("creating a CodeServer archived on deletion")
+			cmd = exec.Command("kubectl", "apply", "-f", "-")
+			cmd.Stdin = strings.NewReader(codeServerManifest)
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			EventuallyWithOffset(1, func() error {
+				cmd := exec.Command("kubectl", "rollout", "status", "deployment/archived", "-n", "default", "--timeout=10s")
+				_, err := utils.Run(cmd)
+				return err
+			}, 10*time.Minute, 10*time.Second).Should(Succeed())
+
+			By("deleting the CodeServer")
+			cmd = exec.Command("kubectl", "delete", "codeserver", "archived", "-n", "default", "--timeout=5m")
+			_, err = utils.Run(cmd)
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+			By("finding the archive in the bucket")
+			output, err := aws("s3", "ls", "s3://workspaces/default/archived/")
+			ExpectWithOffset(1, err).NotTo(HaveOccurred())
+			ExpectWithOffset(1, output).To(ContainSubstring(".tar.gz"))
+
+			By("deleting the archived PVC")
+			EventuallyWithOffset(1, func() (string, error) {
+				cmd := exec.Command("kubectl", "get", "pvc", "archived", "-n", "default", "--ignore-not-found", "-o", "name")
+				pvcs, err := utils.Run(cmd)
+				return strings.TrimSpace(string(pvcs)), err
+			}, time.Minute, 5*time.Second).Should(BeEmpty())
+		})
+	})
 })
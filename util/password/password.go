@@ -0,0 +1,34 @@
+package password
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+
+	"github.com/walnuts1018/code-server-operator/util/random"
+)
+
+// The parameters of argon2id recommended by OWASP, which code server accepts in HASHED_PASSWORD.
+const (
+	memory      = 19 * 1024
+	iterations  = 2
+	parallelism = 1
+	saltLength  = 16
+	keyLength   = 32
+)
+
+// Hash returns the argon2id hash of password in the PHC string format, e.g. "$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>".
+func Hash(password string) (string, error) {
+	salt, err := random.Byte(saltLength)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, iterations, memory, parallelism, keyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, memory, iterations, parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
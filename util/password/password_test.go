@@ -0,0 +1,46 @@
+package password
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+)
+
+func TestHash(t *testing.T) {
+	hash, err := Hash("secret")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+
+	prefix := "$argon2id$v=19$m=19456,t=2,p=1$"
+	if !strings.HasPrefix(hash, prefix) {
+		t.Fatalf("Hash() = %q, want prefix %q", hash, prefix)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(hash, prefix), "$")
+	if len(parts) != 2 {
+		t.Fatalf("Hash() = %q, want salt and key", hash)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[0])
+	if err != nil {
+		t.Fatalf("failed to decode salt: %v", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("failed to decode key: %v", err)
+	}
+	if want := argon2.IDKey([]byte("secret"), salt, 2, 19*1024, 1, 32); !bytes.Equal(key, want) {
+		t.Errorf("Hash() key = %x, want %x", key, want)
+	}
+
+	other, err := Hash("secret")
+	if err != nil {
+		t.Fatalf("Hash() error = %v", err)
+	}
+	if hash == other {
+		t.Errorf("Hash() = %q twice, want a random salt", hash)
+	}
+}